@@ -0,0 +1,148 @@
+package arrowlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+const defaultBatchSize = 1024
+
+// KeyHeader is the record metadata header that the key column is taken from.
+const KeyHeader = "key"
+
+// Schema is the schema of every record batch produced by Reader. timestamp is
+// when the record object was written and headers is its metadata, without
+// the key. They are only filled in for WALs that implement InfoReader, such
+// as *s3_log.S3WAL, and are null otherwise.
+var Schema = arrow.NewSchema([]arrow.Field{
+	{Name: "offset", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "timestamp", Type: arrow.FixedWidthTypes.Timestamp_ms, Nullable: true},
+	{Name: "key", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "data", Type: arrow.BinaryTypes.Binary},
+	{Name: "headers", Type: arrow.MapOf(arrow.BinaryTypes.String, arrow.BinaryTypes.String), Nullable: true},
+}, nil)
+
+// InfoReader is a WAL that can also return the details of a record object.
+type InfoReader interface {
+	ReadWithInfo(ctx context.Context, offset uint64) (s3_log.Record, s3_log.RecordInfo, error)
+}
+
+// Reader converts offset ranges of a WAL into Arrow record batches.
+type Reader struct {
+	wal       s3_log.WAL
+	mem       memory.Allocator
+	batchSize int
+}
+
+func NewReader(wal s3_log.WAL, batchSize int) *Reader {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	return &Reader{
+		wal:       wal,
+		mem:       memory.DefaultAllocator,
+		batchSize: batchSize,
+	}
+}
+
+// ReadBatches reads the records in [from, to] and calls fn with a record
+// batch of at most batchSize rows at a time. The batch is released after fn
+// returns, so fn must call Retain if it wants to keep it.
+func (r *Reader) ReadBatches(ctx context.Context, from, to uint64, fn func(arrow.Record) error) error {
+	if from == 0 || from > to {
+		return fmt.Errorf("invalid offset range: [%d, %d]", from, to)
+	}
+	builder := array.NewRecordBuilder(r.mem, Schema)
+	defer builder.Release()
+	offsets := builder.Field(0).(*array.Uint64Builder)
+	timestamps := builder.Field(1).(*array.TimestampBuilder)
+	keys := builder.Field(2).(*array.StringBuilder)
+	data := builder.Field(3).(*array.BinaryBuilder)
+	headers := builder.Field(4).(*array.MapBuilder)
+	headerKeys := headers.KeyBuilder().(*array.StringBuilder)
+	headerValues := headers.ItemBuilder().(*array.StringBuilder)
+	infoReader, withInfo := r.wal.(InfoReader)
+
+	flush := func() error {
+		batch := builder.NewRecord()
+		defer batch.Release()
+		return fn(batch)
+	}
+
+	rows := 0
+	for offset := from; offset <= to; offset++ {
+		var record s3_log.Record
+		var info s3_log.RecordInfo
+		var err error
+		if withInfo {
+			record, info, err = infoReader.ReadWithInfo(ctx, offset)
+		} else {
+			record, err = r.wal.Read(ctx, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read offset %d: %w", offset, err)
+		}
+		offsets.Append(record.Offset)
+		data.Append(record.Data)
+		if !withInfo {
+			timestamps.AppendNull()
+			keys.AppendNull()
+			headers.AppendNull()
+		} else {
+			timestamps.Append(arrow.Timestamp(info.LastModified.UnixMilli()))
+			if key, ok := info.Metadata[KeyHeader]; ok {
+				keys.Append(key)
+			} else {
+				keys.AppendNull()
+			}
+			names := make([]string, 0, len(info.Metadata))
+			for name := range info.Metadata {
+				if name != KeyHeader {
+					names = append(names, name)
+				}
+			}
+			slices.Sort(names)
+			headers.Append(true)
+			for _, name := range names {
+				headerKeys.Append(name)
+				headerValues.Append(info.Metadata[name])
+			}
+		}
+		rows++
+		if rows == r.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			rows = 0
+		}
+	}
+	if rows > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// WriteIPCStream writes the records in [from, to] to w in the Arrow IPC
+// streaming format.
+func (r *Reader) WriteIPCStream(ctx context.Context, w io.Writer, from, to uint64) error {
+	writer := ipc.NewWriter(w, ipc.WithSchema(Schema), ipc.WithAllocator(r.mem))
+	err := r.ReadBatches(ctx, from, to, func(batch arrow.Record) error {
+		if err := writer.Write(batch); err != nil {
+			return fmt.Errorf("failed to write record batch: %w", err)
+		}
+		return nil
+	})
+	if closeErr := writer.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close IPC stream: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package arrowlog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/s3test"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func TestWriteIPCStream(t *testing.T) {
+	ctx := context.Background()
+	wal := &waltest.MemWAL{}
+	for i := 0; i < 10; i++ {
+		wal.Append(ctx, []byte(fmt.Sprintf("record-%d", i+1)))
+	}
+
+	var buf bytes.Buffer
+	if err := NewReader(wal, 3).WriteIPCStream(ctx, &buf, 2, 8); err != nil {
+		t.Fatalf("failed to write IPC stream: %v", err)
+	}
+
+	reader, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to open IPC stream: %v", err)
+	}
+	defer reader.Release()
+
+	expected := uint64(2)
+	batches := 0
+	for reader.Next() {
+		batch := reader.Record()
+		batches++
+		offsets := batch.Column(0).(*array.Uint64)
+		data := batch.Column(3).(*array.Binary)
+		for i := 0; i < int(batch.NumRows()); i++ {
+			if offsets.Value(i) != expected {
+				t.Errorf("offset mismatch: expected %d, got %d", expected, offsets.Value(i))
+			}
+			if want := fmt.Sprintf("record-%d", expected); string(data.Value(i)) != want {
+				t.Errorf("data mismatch: expected %q, got %q", want, data.Value(i))
+			}
+			expected++
+		}
+	}
+	if expected != 9 {
+		t.Errorf("expected to read up to offset 8, stopped at %d", expected-1)
+	}
+	if batches != 3 {
+		t.Errorf("expected 3 batches, got %d", batches)
+	}
+}
+
+func TestReadBatchesWithInfo(t *testing.T) {
+	ctx := context.Background()
+	client := s3test.Client()
+	wal := s3_log.NewS3WAL(client, s3test.Bucket(t, client), s3test.RandomStr())
+	if _, err := wal.AppendWithMetadata(ctx, []byte("signup"), map[string]string{"key": "alice", "source": "web"}); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if _, err := wal.Append(ctx, []byte("no headers")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	rows := 0
+	err := NewReader(wal, 10).ReadBatches(ctx, 1, 2, func(batch arrow.Record) error {
+		timestamps := batch.Column(1).(*array.Timestamp)
+		keys := batch.Column(2).(*array.String)
+		headers := batch.Column(4).(*array.Map)
+		rows += int(batch.NumRows())
+		for i := 0; i < int(batch.NumRows()); i++ {
+			if timestamps.IsNull(i) || timestamps.Value(i) == 0 {
+				t.Errorf("expected a timestamp in row %d", i)
+			}
+		}
+		if keys.IsNull(0) || keys.Value(0) != "alice" {
+			t.Errorf("expected key alice in the first row, got %q", keys.Value(0))
+		}
+		if !keys.IsNull(1) {
+			t.Errorf("expected no key in the second row, got %q", keys.Value(1))
+		}
+		start, end := headers.ValueOffsets(0)
+		names := headers.Keys().(*array.String)
+		values := headers.Items().(*array.String)
+		if end-start != 1 || names.Value(int(start)) != "source" || values.Value(int(start)) != "web" {
+			t.Errorf("expected only the source header in the first row, got %d headers", end-start)
+		}
+		if start, end = headers.ValueOffsets(1); end != start {
+			t.Errorf("expected no headers in the second row, got %d", end-start)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read batches: %v", err)
+	}
+	if rows != 2 {
+		t.Errorf("expected 2 rows, got %d", rows)
+	}
+}
@@ -0,0 +1,208 @@
+package celfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// DefaultCostLimit bounds the work a single evaluation may do, so that a
+// client cannot tie up a server with an expensive expression.
+const DefaultCostLimit = 10000
+
+// Filter is a compiled CEL expression evaluated against a record. The
+// expression sees these variables:
+//
+//	offset  int    offset of the record
+//	data    bytes  payload of the record
+//	json    dyn    payload decoded as JSON, or null if it is not JSON
+//
+// and must evaluate to a bool, e.g. `json.level == "error" && offset > 100`.
+// A record whose payload lacks a field the expression looks at does not
+// match, so one filter works over payloads of different shapes. Use has(),
+// e.g. `!has(json.level)`, to match on the absence of a field.
+type Filter struct {
+	expr    string
+	program cel.Program
+}
+
+// jsonGet is the function field and index accesses on json are rewritten
+// to. The parser does not accept its name, so expressions cannot call it.
+const jsonGet = "@json_get"
+
+// errMissingField is what jsonGet evaluates to when the payload has no value
+// at the field or index
+var errMissingField = errors.New("no such field in payload")
+
+var env = func() *cel.Env {
+	e, err := cel.NewEnv(
+		cel.Variable("offset", cel.IntType),
+		cel.Variable("data", cel.BytesType),
+		cel.Variable("json", cel.DynType),
+		cel.Function(jsonGet,
+			cel.Overload("json_get_dyn_dyn", []*cel.Type{cel.DynType, cel.DynType}, cel.DynType,
+				cel.BinaryBinding(getField))),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}()
+
+func Compile(expr string, costLimit uint64) (*Filter, error) {
+	checked, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile filter: %w", issues.Err())
+	}
+	checked, issues = cel.NewStaticOptimizer(jsonAccess{}).Optimize(env, checked)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile filter: %w", issues.Err())
+	}
+	if checked.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("filter must evaluate to bool, got %s", checked.OutputType())
+	}
+	program, err := env.Program(checked, cel.CostLimit(costLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build filter program: %w", err)
+	}
+	return &Filter{expr: expr, program: program}, nil
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+func (f *Filter) Match(record s3_log.Record) (bool, error) {
+	var payload any
+	if err := json.Unmarshal(record.Data, &payload); err != nil {
+		payload = nil
+	}
+	out, _, err := f.program.Eval(map[string]any{
+		"offset": int64(record.Offset),
+		"data":   record.Data,
+		"json":   payload,
+	})
+	if errors.Is(err, errMissingField) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate filter at offset %d: %w", record.Offset, err)
+	}
+	if out == types.True {
+		return true, nil
+	}
+	return false, nil
+}
+
+// jsonAccess rewrites `json.a` and `json[k]`, and further accesses on their
+// results, into calls of jsonGet, so that a missing field evaluates to
+// errMissingField instead of an error that can only be told apart from
+// others by its message. Accesses inside has() are left alone, since has()
+// already handles missing fields.
+type jsonAccess struct{}
+
+func (jsonAccess) Optimize(ctx *cel.OptimizerContext, a *ast.AST) *ast.AST {
+	accesses := ast.MatchDescendants(ast.NavigateAST(a), func(e ast.NavigableExpr) bool {
+		switch e.Kind() {
+		case ast.SelectKind:
+			return !e.AsSelect().IsTestOnly() && onJSON(e.AsSelect().Operand())
+		case ast.CallKind:
+			return e.AsCall().FunctionName() == operators.Index && onJSON(e.AsCall().Args()[0])
+		}
+		return false
+	})
+	for _, e := range accesses {
+		var operand, key ast.Expr
+		if e.Kind() == ast.SelectKind {
+			operand, key = e.AsSelect().Operand(), ctx.NewLiteral(types.String(e.AsSelect().FieldName()))
+		} else {
+			operand, key = e.AsCall().Args()[0], e.AsCall().Args()[1]
+		}
+		ctx.UpdateExpr(e, ctx.NewCall(jsonGet, operand, key))
+	}
+	return a
+}
+
+// onJSON reports whether e is the json variable or an access on it
+func onJSON(e ast.Expr) bool {
+	switch e.Kind() {
+	case ast.IdentKind:
+		return e.AsIdent() == "json"
+	case ast.SelectKind:
+		return !e.AsSelect().IsTestOnly() && onJSON(e.AsSelect().Operand())
+	case ast.CallKind:
+		fn := e.AsCall().FunctionName()
+		return (fn == operators.Index || fn == jsonGet) && onJSON(e.AsCall().Args()[0])
+	}
+	return false
+}
+
+// getField returns the value of a JSON object at key, or of a JSON array at
+// index key, and errMissingField if there is none
+func getField(v, key ref.Val) ref.Val {
+	switch v := v.(type) {
+	case traits.Mapper:
+		// a key of the wrong type finds an error, which is as missing
+		if value, found := v.Find(key); found && !types.IsError(value) {
+			return value
+		}
+	case traits.Lister:
+		i, err := types.IndexOrError(key)
+		if err == nil && i >= 0 && types.Int(i) < v.Size().(types.Int) {
+			return v.Get(types.Int(i))
+		}
+	}
+	return types.WrapErr(errMissingField)
+}
+
+// Cache keeps compiled filters by expression, since clients tend to send the
+// same few expressions over and over. It holds at most size filters and
+// drops an arbitrary one when full.
+type Cache struct {
+	mu        sync.Mutex
+	size      int
+	costLimit uint64
+	filters   map[string]*Filter
+}
+
+func NewCache(size int, costLimit uint64) *Cache {
+	return &Cache{
+		size:      size,
+		costLimit: costLimit,
+		filters:   make(map[string]*Filter, size),
+	}
+}
+
+func (c *Cache) Get(expr string) (*Filter, error) {
+	c.mu.Lock()
+	f, ok := c.filters[expr]
+	c.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+
+	f, err := Compile(expr, c.costLimit)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.filters) >= c.size {
+		for k := range c.filters {
+			delete(c.filters, k)
+			break
+		}
+	}
+	c.filters[expr] = f
+	return f, nil
+}
@@ -0,0 +1,76 @@
+package celfilter
+
+import (
+	"strings"
+	"testing"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr   string
+		record s3_log.Record
+		match  bool
+	}{
+		{`offset > 10`, s3_log.Record{Offset: 11}, true},
+		{`offset > 10`, s3_log.Record{Offset: 10}, false},
+		{`json.level == "error"`, s3_log.Record{Offset: 1, Data: []byte(`{"level":"error"}`)}, true},
+		{`json.level == "error"`, s3_log.Record{Offset: 1, Data: []byte(`{"level":"info"}`)}, false},
+		{`json == null`, s3_log.Record{Offset: 1, Data: []byte("not json")}, true},
+		{`data.size() == 5`, s3_log.Record{Offset: 1, Data: []byte("hello")}, true},
+		// payloads without the field do not match instead of failing
+		{`json.level == "error"`, s3_log.Record{Offset: 1, Data: []byte(`{"msg":"hi"}`)}, false},
+		{`json.level == "error"`, s3_log.Record{Offset: 1, Data: []byte("not json")}, false},
+		{`json.level == "error"`, s3_log.Record{Offset: 1, Data: []byte(`[1, 2]`)}, false},
+		{`json.user.name == "bob"`, s3_log.Record{Offset: 1, Data: []byte(`{"user":"bob"}`)}, false},
+		{`!has(json.level)`, s3_log.Record{Offset: 1, Data: []byte(`{"msg":"hi"}`)}, true},
+		{`json.tags[2] == "x"`, s3_log.Record{Offset: 1, Data: []byte(`{"tags":["a"]}`)}, false},
+		{`json.tags[0] == "a"`, s3_log.Record{Offset: 1, Data: []byte(`{"tags":["a"]}`)}, true},
+		{`json["level"] == "error" || offset == 1`, s3_log.Record{Offset: 1, Data: []byte(`{}`)}, true},
+		{`json.items.exists(i, i == 2)`, s3_log.Record{Offset: 1, Data: []byte(`{"msg":"hi"}`)}, false},
+		{`json.items.exists(i, i == 2)`, s3_log.Record{Offset: 1, Data: []byte(`{"items":[1,2]}`)}, true},
+	}
+	cache := NewCache(2, DefaultCostLimit)
+	for _, tt := range tests {
+		f, err := cache.Get(tt.expr)
+		if err != nil {
+			t.Fatalf("failed to compile %q: %v", tt.expr, err)
+		}
+		match, err := f.Match(tt.record)
+		if err != nil {
+			t.Fatalf("failed to evaluate %q: %v", tt.expr, err)
+		}
+		if match != tt.match {
+			t.Errorf("%q on %q: expected %v, got %v", tt.expr, tt.record.Data, tt.match, match)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	if _, err := Compile(`offset + 1`, DefaultCostLimit); err == nil {
+		t.Error("expected error for non-bool filter, got nil")
+	}
+	if _, err := Compile(`offset >`, DefaultCostLimit); err == nil {
+		t.Error("expected error for invalid filter, got nil")
+	}
+
+	// only missing fields are a non-match, other errors are returned
+	f, err := Compile(`int(json.n) > 1`, DefaultCostLimit)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if _, err = f.Match(s3_log.Record{Offset: 1, Data: []byte(`{"n":"abc"}`)}); err == nil {
+		t.Error("expected conversion error, got nil")
+	}
+
+	f, err = Compile(`json.items.all(x, json.items.all(y, x != y || x == y))`, 10)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	items := "[" + strings.Repeat("1,", 99) + "1]"
+	_, err = f.Match(s3_log.Record{Offset: 1, Data: []byte(`{"items":` + items + `}`)})
+	if err == nil {
+		t.Error("expected cost limit error, got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package s3_log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ChainReader reads a log and then every log it was sealed into, one after
+// the other, as if they were a single log. Offsets restart in a successor
+// named by Seal, so a position in the chain is a log and an offset in it, as
+// returned by Position.
+type ChainReader struct {
+	wal    *S3WAL
+	offset uint64
+}
+
+// NewChainReader returns a reader that starts at offset in wal, 0 being the
+// same as 1.
+func NewChainReader(wal *S3WAL, offset uint64) *ChainReader {
+	return &ChainReader{wal: wal, offset: max(offset, 1)}
+}
+
+// Next returns the next record of the chain, following the seal marker of a
+// log into its successor. It returns false once it has read every record
+// written so far, and can then be called again to tail the chain. A log
+// sealed without a successor ends the chain.
+func (r *ChainReader) Next(ctx context.Context) (Record, bool, error) {
+	for {
+		record, err := r.wal.Read(ctx, r.offset)
+		if err == nil {
+			r.offset++
+			return record, true, nil
+		}
+		if isNotFound(err) {
+			return Record{}, false, nil
+		}
+		if !errors.Is(err, ErrSealed) {
+			return Record{}, false, fmt.Errorf("failed to read offset %d: %w", r.offset, err)
+		}
+		successor, next, err := r.wal.successorAt(ctx, r.offset)
+		if err != nil {
+			return Record{}, false, err
+		}
+		if successor == nil {
+			return Record{}, false, nil
+		}
+		r.wal, r.offset = successor, next
+	}
+}
+
+// Position returns the bucket and prefix of the log the reader is in and the
+// next offset it will read from it. A reader resumes from there with
+// NewChainReader(NewS3WAL(client, bucketName, prefix), offset).
+func (r *ChainReader) Position() (string, string, uint64) {
+	return r.wal.bucketName, r.wal.prefix, r.offset
+}
+
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	return errors.As(err, &nsk) || errors.As(err, &nf)
+}
@@ -0,0 +1,65 @@
+package s3_log
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestChainReader(t *testing.T) {
+	first, cleanupFirst := getWAL(t)
+	defer cleanupFirst()
+	ctx := context.Background()
+
+	var expected []string
+	appendTo := func(wal *S3WAL, data string) {
+		if _, err := wal.Append(ctx, []byte(data)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		expected = append(expected, data)
+	}
+	appendTo(first, "day-1/a")
+	appendTo(first, "day-1/b")
+
+	// a successor from Seal starts over at offset 1
+	second := NewS3WAL(first.client, first.bucketName, first.prefix+"-day-2")
+	if _, err := first.Seal(ctx, second.prefix); err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	appendTo(second, "day-2/a")
+
+	// a migration destination continues at the offset of the seal marker
+	third, cleanupThird := getWAL(t)
+	defer cleanupThird()
+	if _, err := second.Migrate(ctx, third); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	appendTo(third, "day-2/b")
+
+	reader := NewChainReader(first, 0)
+	var got []string
+	for {
+		record, ok, err := reader.Next(ctx)
+		if err != nil {
+			t.Fatalf("failed to read chain: %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(record.Data))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// the reader tails the end of the chain
+	appendTo(third, "day-2/c")
+	record, ok, err := reader.Next(ctx)
+	if err != nil || !ok || string(record.Data) != "day-2/c" {
+		t.Fatalf("expected to tail day-2/c, got %q, %v, %v", record.Data, ok, err)
+	}
+	bucketName, prefix, offset := reader.Position()
+	if bucketName != third.bucketName || prefix != third.prefix || offset != 4 {
+		t.Errorf("expected position %s/%s@4, got %s/%s@%d", third.bucketName, third.prefix, bucketName, prefix, offset)
+	}
+}
@@ -0,0 +1,217 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	chunkHeaderVersion = 1
+	// version, chunk count, chunk index, first offset, payload size, payload checksum
+	chunkHeaderSize = 1 + 4 + 4 + 8 + 8 + 32
+)
+
+var (
+	ErrPartialRecord = errors.New("record is missing some of its chunks")
+	ErrNotFirstChunk = errors.New("offset is not the first chunk of a record")
+	// errMissingChunk marks a partial record whose next chunk does not exist
+	// yet, so its writer may still be appending it
+	errMissingChunk = errors.New("chunk does not exist")
+)
+
+type chunkHeader struct {
+	count    uint32
+	index    uint32
+	first    uint64 // offset of the first chunk, 0 in the first chunk itself
+	size     uint64
+	checksum [32]byte
+}
+
+func (h chunkHeader) encode(chunk []byte) []byte {
+	buf := make([]byte, chunkHeaderSize, chunkHeaderSize+len(chunk))
+	buf[0] = chunkHeaderVersion
+	binary.BigEndian.PutUint32(buf[1:5], h.count)
+	binary.BigEndian.PutUint32(buf[5:9], h.index)
+	binary.BigEndian.PutUint64(buf[9:17], h.first)
+	binary.BigEndian.PutUint64(buf[17:25], h.size)
+	copy(buf[25:57], h.checksum[:])
+	return append(buf, chunk...)
+}
+
+func decodeChunk(data []byte) (chunkHeader, []byte, error) {
+	if len(data) < chunkHeaderSize {
+		return chunkHeader{}, nil, fmt.Errorf("invalid chunk: data too short")
+	}
+	if data[0] != chunkHeaderVersion {
+		return chunkHeader{}, nil, fmt.Errorf("invalid chunk: unknown version %d", data[0])
+	}
+	var h chunkHeader
+	h.count = binary.BigEndian.Uint32(data[1:5])
+	h.index = binary.BigEndian.Uint32(data[5:9])
+	h.first = binary.BigEndian.Uint64(data[9:17])
+	h.size = binary.BigEndian.Uint64(data[17:25])
+	copy(h.checksum[:], data[25:57])
+	if h.count == 0 || h.index >= h.count || (h.index == 0) != (h.first == 0) {
+		return chunkHeader{}, nil, fmt.Errorf("invalid chunk: bad header")
+	}
+	return h, data[chunkHeaderSize:], nil
+}
+
+// ChunkedWAL splits payloads larger than maxChunkSize into chunk records at
+// consecutive offsets of the underlying WAL. Each chunk carries a header that
+// links it to the first one, which also holds the size and checksum of the
+// whole payload. A logical record is addressed by the offset of its first
+// chunk. Every record written through ChunkedWAL has a header, so a log must
+// be written either only through it or never.
+type ChunkedWAL struct {
+	wal          WAL
+	maxChunkSize int
+}
+
+func NewChunkedWAL(wal WAL, maxChunkSize int) (*ChunkedWAL, error) {
+	if maxChunkSize <= 0 {
+		return nil, fmt.Errorf("max chunk size must be positive, got %d", maxChunkSize)
+	}
+	return &ChunkedWAL{
+		wal:          wal,
+		maxChunkSize: maxChunkSize,
+	}, nil
+}
+
+// Append writes data as one or more chunks and returns the offset of the
+// first. If it fails halfway, the chunks already written are left behind as
+// a partial record, which readers skip.
+func (c *ChunkedWAL) Append(ctx context.Context, data []byte) (uint64, error) {
+	count := max(1, (len(data)+c.maxChunkSize-1)/c.maxChunkSize)
+	h := chunkHeader{
+		count:    uint32(count),
+		size:     uint64(len(data)),
+		checksum: sha256.Sum256(data),
+	}
+	var first uint64
+	for i := 0; i < count; i++ {
+		chunk := data[i*c.maxChunkSize : min(len(data), (i+1)*c.maxChunkSize)]
+		h.index = uint32(i)
+		h.first = first
+		offset, err := c.wal.Append(ctx, h.encode(chunk))
+		if err != nil {
+			return 0, fmt.Errorf("failed to append chunk %d of %d: %w", i+1, count, err)
+		}
+		if i == 0 {
+			first = offset
+		} else if offset != first+uint64(i) {
+			return 0, fmt.Errorf("chunk %d landed at offset %d, expected %d", i+1, offset, first+uint64(i))
+		}
+	}
+	return first, nil
+}
+
+// Read reassembles the record whose first chunk is at offset and verifies
+// the whole payload. It returns ErrNotFirstChunk if offset is in the middle
+// of a record and ErrPartialRecord if the record was never fully written,
+// including when its last chunks are missing at the tail of the log.
+func (c *ChunkedWAL) Read(ctx context.Context, offset uint64) (Record, error) {
+	record, _, err := c.read(ctx, offset)
+	return record, err
+}
+
+// read returns the record at offset along with the number of chunks it spans
+func (c *ChunkedWAL) read(ctx context.Context, offset uint64) (Record, uint32, error) {
+	first, err := c.wal.Read(ctx, offset)
+	if err != nil {
+		return Record{}, 0, err
+	}
+	h, chunk, err := decodeChunk(first.Data)
+	if err != nil {
+		return Record{}, 0, fmt.Errorf("failed to decode chunk at offset %d: %w", offset, err)
+	}
+	if h.index != 0 {
+		return Record{}, h.count - h.index, ErrNotFirstChunk
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(min(h.size, uint64(c.maxChunkSize)*uint64(h.count))))
+	buf.Write(chunk)
+	for i := uint32(1); i < h.count; i++ {
+		next, err := c.wal.Read(ctx, offset+uint64(i))
+		if err != nil {
+			if errors.Is(err, ErrSealed) {
+				return Record{}, i, ErrPartialRecord
+			}
+			if isNotFound(err) {
+				// the writer crashed at the tail, or is still appending
+				return Record{}, i, fmt.Errorf("%w: %w for chunk %d of %d", ErrPartialRecord, errMissingChunk, i+1, h.count)
+			}
+			return Record{}, i, fmt.Errorf("failed to read chunk %d of %d: %w", i+1, h.count, err)
+		}
+		nh, chunk, err := decodeChunk(next.Data)
+		if err != nil || nh.first != offset || nh.index != i {
+			// a later record took the place of this chunk
+			return Record{}, i, ErrPartialRecord
+		}
+		buf.Write(chunk)
+	}
+	if uint64(buf.Len()) != h.size || sha256.Sum256(buf.Bytes()) != h.checksum {
+		return Record{}, h.count, fmt.Errorf("checksum mismatch for record at offset %d", offset)
+	}
+	return Record{Offset: offset, Data: buf.Bytes()}, h.count, nil
+}
+
+// ReadNext returns the first complete record at or after offset, skipping
+// partial records and chunks in the middle of a record, together with the
+// offset to continue reading from. A record at the tail that is missing its
+// last chunks is not skipped, since its writer may still be appending them;
+// ReadNext returns ErrPartialRecord and the offset of that record instead.
+// Once a later record is appended in place of a missing chunk, it is skipped.
+func (c *ChunkedWAL) ReadNext(ctx context.Context, offset uint64) (Record, uint64, error) {
+	for {
+		record, span, err := c.read(ctx, offset)
+		if err == nil {
+			return record, offset + uint64(span), nil
+		}
+		if errors.Is(err, errMissingChunk) || !errors.Is(err, ErrPartialRecord) && !errors.Is(err, ErrNotFirstChunk) {
+			return Record{}, offset, err
+		}
+		offset += uint64(max(span, 1))
+	}
+}
+
+// LastRecord returns the last complete record, skipping a partial record
+// left at the tail by a crashed writer.
+func (c *ChunkedWAL) LastRecord(ctx context.Context) (Record, error) {
+	last, err := c.wal.LastRecord(ctx)
+	if err != nil {
+		return Record{}, err
+	}
+	offset := last.Offset
+	for offset > 0 {
+		data := last.Data
+		if last.Offset != offset {
+			r, err := c.wal.Read(ctx, offset)
+			if err != nil {
+				return Record{}, err
+			}
+			data = r.Data
+		}
+		h, _, err := decodeChunk(data)
+		if err != nil {
+			return Record{}, fmt.Errorf("failed to decode chunk at offset %d: %w", offset, err)
+		}
+		first := offset
+		if h.index > 0 {
+			first = h.first
+		}
+		if h.index == h.count-1 {
+			record, _, err := c.read(ctx, first)
+			if !errors.Is(err, ErrPartialRecord) {
+				return record, err
+			}
+		}
+		offset = first - 1
+	}
+	return Record{}, ErrEmpty
+}
@@ -0,0 +1,136 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestChunkedAppendAndRead(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+	chunked, err := NewChunkedWAL(wal, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := []byte("fits in one chunk")
+	large := make([]byte, 4500)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	var offsets []uint64
+	for _, data := range [][]byte{small, large, {}, small} {
+		offset, err := chunked.Append(ctx, data)
+		if err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		offsets = append(offsets, offset)
+	}
+	if want := []uint64{1, 2, 7, 8}; !equalOffsets(offsets, want) {
+		t.Fatalf("expected offsets %v, got %v", want, offsets)
+	}
+
+	record, err := chunked.Read(ctx, 2)
+	if err != nil {
+		t.Fatalf("failed to read chunked record: %v", err)
+	}
+	if !bytes.Equal(record.Data, large) {
+		t.Errorf("reassembled record does not match, got %d bytes", len(record.Data))
+	}
+	if _, err = chunked.Read(ctx, 3); !errors.Is(err, ErrNotFirstChunk) {
+		t.Errorf("expected ErrNotFirstChunk, got %v", err)
+	}
+
+	last, err := chunked.LastRecord(ctx)
+	if err != nil {
+		t.Fatalf("failed to get last record: %v", err)
+	}
+	if last.Offset != 8 || !bytes.Equal(last.Data, small) {
+		t.Errorf("expected last record at 8, got %d with %q", last.Offset, last.Data)
+	}
+}
+
+func TestChunkedPartialRecord(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+	chunked, err := NewChunkedWAL(wal, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chunked.Append(ctx, []byte("complete")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	// a writer crashed after the first two of three chunks
+	payload := []byte("this payload is thirty bytes!!")
+	h := chunkHeader{count: 3, size: uint64(len(payload)), checksum: sha256.Sum256(payload)}
+	first, err := wal.Append(ctx, h.encode(payload[:10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.index, h.first = 1, first
+	if _, err = wal.Append(ctx, h.encode(payload[10:20])); err != nil {
+		t.Fatal(err)
+	}
+
+	// the missing chunk may still be on its way, so readers wait at the record
+	if _, err = chunked.Read(ctx, first); !errors.Is(err, ErrPartialRecord) {
+		t.Errorf("expected ErrPartialRecord for a record missing its last chunk, got %v", err)
+	}
+	if _, next, err := chunked.ReadNext(ctx, first); !errors.Is(err, ErrPartialRecord) || next != first {
+		t.Errorf("expected ErrPartialRecord at offset %d, got %v at %d", first, err, next)
+	}
+
+	last, err := chunked.LastRecord(ctx)
+	if err != nil {
+		t.Fatalf("failed to get last record: %v", err)
+	}
+	if last.Offset != 1 {
+		t.Errorf("expected partial tail to be skipped, got last record at %d", last.Offset)
+	}
+
+	// the restarted writer carries on after the partial record
+	offset, err := chunked.Append(ctx, []byte("after the crash"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if _, err = chunked.Read(ctx, first); !errors.Is(err, ErrPartialRecord) {
+		t.Errorf("expected ErrPartialRecord, got %v", err)
+	}
+
+	var got []string
+	for next := uint64(1); next <= offset; {
+		var record Record
+		record, next, err = chunked.ReadNext(ctx, next)
+		if err != nil {
+			t.Fatalf("failed to read next: %v", err)
+		}
+		got = append(got, string(record.Data))
+	}
+	if len(got) != 2 || got[0] != "complete" || got[1] != "after the crash" {
+		t.Errorf("expected partial record to be skipped, got %q", got)
+	}
+}
+
+func TestChunkedInvalidSize(t *testing.T) {
+	if _, err := NewChunkedWAL(nil, 0); err == nil {
+		t.Error("expected error for a max chunk size of 0, got nil")
+	}
+}
+
+func equalOffsets(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/avinassh/s3-log/consumergroup"
+)
+
+const groupsUsage = `usage: s3log groups <command> [flags] [group]
+
+commands:
+  list              list the consumer groups of a log
+  describe <group>  show committed offsets, lag and members of a group
+  reset <group>     move the committed offsets of a group, see -to
+`
+
+func runGroups(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, groupsUsage)
+		return fmt.Errorf("expected a command")
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("groups "+cmd, flag.ExitOnError)
+	var lf logFlags
+	lf.register(fs)
+	timeout := fs.Duration("session-timeout", 30*time.Second, "time since the last heartbeat after which a member counts as gone")
+	to := fs.String("to", "", "reset target: earliest, latest, an offset or an RFC 3339 time")
+	force := fs.Bool("force", false, "reset even if the group has active members, fencing them")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), groupsUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	client, err := lf.client(ctx)
+	if err != nil {
+		return err
+	}
+	c := consumergroup.NewCoordinator(client, lf.bucket, lf.prefix, *timeout)
+	// the log is a single partition, named after its prefix
+	wal, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+	partitions := []consumergroup.Partition{{Name: lf.prefix, WAL: wal}}
+
+	switch cmd {
+	case "list":
+		groups, err := c.ListGroups(ctx)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			fmt.Println(g)
+		}
+		return nil
+	case "describe":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expected exactly one group")
+		}
+		d, err := c.Describe(ctx, fs.Arg(0), partitions)
+		if err != nil {
+			return err
+		}
+		return printDescription(d)
+	case "reset":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expected exactly one group")
+		}
+		target, err := parseResetTarget(*to)
+		if err != nil {
+			return err
+		}
+		offsets, err := c.Reset(ctx, fs.Arg(0), partitions, target, *force)
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			fmt.Printf("%s\t%d\n", p.Name, offsets[p.Name])
+		}
+		return nil
+	}
+	fmt.Fprint(os.Stderr, groupsUsage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func parseResetTarget(to string) (consumergroup.ResetTarget, error) {
+	switch to {
+	case "":
+		return consumergroup.ResetTarget{}, fmt.Errorf("-to is required")
+	case "earliest":
+		return consumergroup.Earliest(), nil
+	case "latest":
+		return consumergroup.Latest(), nil
+	}
+	if offset, err := strconv.ParseUint(to, 10, 64); err == nil {
+		return consumergroup.ToOffset(offset), nil
+	}
+	t, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return consumergroup.ResetTarget{}, fmt.Errorf("invalid -to %q, expected earliest, latest, an offset or an RFC 3339 time", to)
+	}
+	return consumergroup.ToTime(t), nil
+}
+
+func printDescription(d *consumergroup.Description) error {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "group %s, epoch %d\n\n", d.Group, d.Epoch)
+	fmt.Fprintln(w, "PARTITION\tCOMMITTED\tEND\tLAG\tLAST COMMIT")
+	for _, p := range d.Partitions {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", p.Partition, p.Committed, p.End, p.Lag, formatTime(p.CommittedAt))
+	}
+	fmt.Fprintln(w, "\nMEMBER\tJOINED\tLAST HEARTBEAT\tACTIVE\tPARTITIONS")
+	for _, m := range d.Members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", m.Name, formatTime(m.JoinedAt), formatTime(m.LastHeartbeat), m.Active, strings.Join(m.Partitions, ","))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/config"
+)
+
+const usage = `usage: s3log <command> [flags] [args]
+
+commands:
+  query "SELECT ..."   run a SQL query over the JSON records of a log
+  read                 print a page of records and a cursor to resume from
+  verify               find records that were overwritten or deleted
+  groups list|describe|reset
+                       administer the consumer groups of a log
+  serve                run the connectors of a config file
+
+run "s3log <command> -h" for the flags of a command
+`
+
+// logFlags are the flags every command uses to open a log, either given
+// directly or taken from a config file
+type logFlags struct {
+	config   string
+	log      string
+	bucket   string
+	prefix   string
+	endpoint string
+	region   string
+	// versioned is only ever set from the config
+	versioned bool
+}
+
+func (f *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", os.Getenv("S3LOG_CONFIG"), "config file to take the log from, defaults to $S3LOG_CONFIG")
+	fs.StringVar(&f.log, "log", "", "name of the log in the config file, may be left out if it has only one")
+	fs.StringVar(&f.bucket, "bucket", "", "bucket of the log")
+	fs.StringVar(&f.prefix, "prefix", "", "prefix of the log")
+	fs.StringVar(&f.endpoint, "endpoint", "", "S3 endpoint, e.g. http://127.0.0.1:9000 for MinIO")
+	fs.StringVar(&f.region, "region", "", "AWS region, defaults to the AWS config")
+}
+
+// resolve fills in what the flags leave out from the config file
+func (f *logFlags) resolve() error {
+	if f.config == "" {
+		return nil
+	}
+	c, err := config.Load(f.config)
+	if err != nil {
+		return err
+	}
+	name := f.log
+	if name == "" {
+		if len(c.Logs) != 1 {
+			return fmt.Errorf("-log is required, the config has %d logs", len(c.Logs))
+		}
+		for n := range c.Logs {
+			name = n
+		}
+	}
+	lc, ok := c.Logs[name]
+	if !ok {
+		return fmt.Errorf("config has no log named %q", name)
+	}
+	f.bucket = cmp.Or(f.bucket, lc.Bucket)
+	f.prefix = cmp.Or(f.prefix, lc.Prefix)
+	f.endpoint = cmp.Or(f.endpoint, lc.Endpoint)
+	f.region = cmp.Or(f.region, lc.Region)
+	f.versioned = lc.Versioned
+	// resolve once, later calls keep what the flags say
+	f.config = ""
+	return nil
+}
+
+func (f *logFlags) open(ctx context.Context) (*s3_log.S3WAL, error) {
+	client, err := f.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.versioned {
+		return s3_log.NewVersionedS3WAL(client, f.bucket, f.prefix), nil
+	}
+	return s3_log.NewS3WAL(client, f.bucket, f.prefix), nil
+}
+
+func (f *logFlags) client(ctx context.Context) (*s3.Client, error) {
+	if err := f.resolve(); err != nil {
+		return nil, err
+	}
+	if f.bucket == "" || f.prefix == "" {
+		return nil, fmt.Errorf("-bucket and -prefix are required")
+	}
+	return newClient(ctx, f.endpoint, f.region)
+}
+
+func newClient(ctx context.Context, endpoint, region string) (*s3.Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	var err error
+	switch os.Args[1] {
+	case "query":
+		err = runQuery(ctx, os.Args[2:])
+	case "read":
+		err = runRead(ctx, os.Args[2:])
+	case "verify":
+		err = runVerify(ctx, os.Args[2:])
+	case "groups":
+		err = runGroups(ctx, os.Args[2:])
+	case "serve":
+		err = runServe(ctx, os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "s3log %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/sqlquery"
+)
+
+func runQuery(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var lf logFlags
+	lf.register(fs)
+	from := fs.Uint64("from", 1, "first offset to scan")
+	to := fs.Uint64("to", 0, "last offset to scan, defaults to the end of the log")
+	since := fs.String("since", "", "only scan records written at or after this RFC 3339 time")
+	until := fs.String("until", "", "only scan records written at or before this RFC 3339 time")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `usage: s3log query [flags] "SELECT ... FROM log ..."`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one query")
+	}
+
+	q, err := sqlquery.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sinceTime, err := parseTimeFlag(*since)
+	if err != nil {
+		return err
+	}
+	untilTime, err := parseTimeFlag(*until)
+	if err != nil {
+		return err
+	}
+	wal, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	last := *to
+	if last == 0 {
+		// the query may bound the offsets itself, but not necessarily below
+		// the end of the log, and Run narrows down to that bound anyway
+		record, err := wal.LastRecord(ctx)
+		if errors.Is(err, s3_log.ErrEmpty) {
+			return printResult(&sqlquery.Result{Columns: q.Columns()})
+		}
+		if err != nil {
+			return err
+		}
+		last = record.Offset
+	}
+
+	first := *from
+	if !sinceTime.IsZero() || !untilTime.IsZero() {
+		if first, last, err = sqlquery.OffsetsBetween(ctx, wal, first, last, sinceTime, untilTime); err != nil {
+			return err
+		}
+	}
+
+	result, err := q.Run(ctx, wal, first, last)
+	if err != nil {
+		return err
+	}
+	return printResult(result)
+}
+
+// parseTimeFlag returns the zero time for an unset flag
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %w", value, err)
+	}
+	return t, nil
+}
+
+func printResult(result *sqlquery.Result) error {
+	var sb strings.Builder
+	sb.WriteString(strings.Join(result.Columns, "\t"))
+	sb.WriteByte('\n')
+	for _, row := range result.Rows {
+		for i, v := range row {
+			if i > 0 {
+				sb.WriteByte('\t')
+			}
+			sb.WriteString(formatValue(v))
+		}
+		sb.WriteByte('\n')
+	}
+	_, err := os.Stdout.WriteString(sb.String())
+	return err
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
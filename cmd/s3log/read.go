@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/celfilter"
+)
+
+func runRead(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	var lf logFlags
+	lf.register(fs)
+	token := fs.String("cursor", "", "cursor printed by a previous read, to resume from")
+	from := fs.Uint64("from", 1, "first offset to read, when not resuming from a cursor")
+	filter := fs.String("filter", "", "CEL expression the records must match, e.g. 'json.level == \"error\"'")
+	limit := fs.Int("limit", 100, "maximum number of records to print")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: s3log read [flags]")
+		fmt.Fprintln(fs.Output(), "prints one record per line as offset<TAB>data and the cursor of the next page to stderr")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := lf.resolve(); err != nil {
+		return err
+	}
+
+	log := lf.bucket + "/" + lf.prefix
+	cursor := s3_log.Cursor{Log: log, Offset: *from, Filter: *filter}
+	if *token != "" {
+		var err error
+		if cursor, err = s3_log.DecodeCursor(*token, log); err != nil {
+			return err
+		}
+		if *filter != "" && *filter != cursor.Filter {
+			return fmt.Errorf("-filter differs from the filter of the cursor %q", cursor.Filter)
+		}
+	}
+
+	var match func(s3_log.Record) (bool, error)
+	if cursor.Filter != "" {
+		f, err := celfilter.Compile(cursor.Filter, celfilter.DefaultCostLimit)
+		if err != nil {
+			return err
+		}
+		match = f.Match
+	}
+	wal, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	records, next, err := s3_log.ReadPage(ctx, wal, cursor, *limit, match)
+	for _, record := range records {
+		fmt.Printf("%d\t%s\n", record.Offset, record.Data)
+	}
+	// print the cursor even on error, so that the records printed are not
+	// read again
+	fmt.Fprintf(os.Stderr, "cursor: %s\n", next.Encode())
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/config"
+	"github.com/avinassh/s3-log/forward"
+	"github.com/avinassh/s3-log/mqttbridge"
+	"github.com/avinassh/s3-log/remotewrite"
+	"github.com/avinassh/s3-log/server"
+)
+
+// newMQTTServer returns a broker for an MQTT connector, listening but not yet
+// serving
+func newMQTTServer(id string, conn config.ConnectorConfig, wals map[string]s3_log.WAL, logger *slog.Logger) (*mqtt.Server, error) {
+	var routes []mqttbridge.Route
+	for _, r := range conn.Routes {
+		routes = append(routes, mqttbridge.Route{Filter: r.Match, WAL: wals[r.Log]})
+	}
+	server, err := mqttbridge.NewServer(routes, logger)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(conn.Auth.Users))
+	for _, u := range conn.Auth.Users {
+		users[u.Username] = u.Password
+	}
+	if err = server.AddHook(mqttbridge.NewAuthHook(users, conn.Auth.AllowAnonymous), nil); err != nil {
+		return nil, err
+	}
+	if err = server.AddListener(listeners.NewTCP(listeners.Config{ID: id, Address: conn.Listen})); err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", conn.Listen, err)
+	}
+	return server, nil
+}
+
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	path := fs.String("config", os.Getenv("S3LOG_CONFIG"), "config file, defaults to $S3LOG_CONFIG")
+	interval := fs.Duration("reload-interval", 10*time.Second, "how often to check the config file for changes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: s3log serve [flags]")
+		fmt.Fprintln(fs.Output(), "runs the connectors and server of the config file until interrupted")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	watcher, err := config.NewWatcher(*path)
+	if err != nil {
+		return err
+	}
+	c := watcher.Current()
+	var level slog.LevelVar
+	lvl, _ := c.Level()
+	level.Set(lvl)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level}))
+
+	// wait for the leases to be released, which happens once stop has
+	// cancelled ctx
+	var leases sync.WaitGroup
+	defer leases.Wait()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// connectors and the server share a Log per log, which serializes the
+	// appends of all of them
+	logs := make(map[string]*server.Log, len(c.Logs))
+	wals := make(map[string]s3_log.WAL, len(c.Logs))
+	for name, lc := range c.Logs {
+		client, err := newClient(ctx, lc.Endpoint, lc.Region)
+		if err != nil {
+			return err
+		}
+		newWAL := s3_log.NewS3WAL
+		if lc.Versioned {
+			newWAL = s3_log.NewVersionedS3WAL
+		}
+		log := server.NewLog(name, newWAL(client, lc.Bucket, lc.Prefix), newWAL(client, lc.Bucket, lc.Prefix))
+		if _, err = log.LastOffset(ctx); err != nil {
+			return fmt.Errorf("failed to open log %s: %w", name, err)
+		}
+		if c.Server != nil && c.Server.Advertise != "" {
+			log.UseLease(s3_log.NewLease(client, lc.Bucket, lc.Prefix, c.Server.Advertise, c.Server.LeaseTTL))
+			leases.Add(1)
+			go func() {
+				defer leases.Done()
+				log.RunLease(ctx, c.Server.LeaseTTL/3, logger)
+			}()
+		}
+		logs[name] = log
+		wals[name] = log
+	}
+
+	errc := make(chan error, len(c.Connectors)+1)
+	receivers := make([]*remotewrite.Receiver, len(c.Connectors))
+	for i, conn := range c.Connectors {
+		switch conn.Type {
+		case config.ConnectorMQTT:
+			broker, err := newMQTTServer(fmt.Sprint("mqtt-", i), conn, wals, logger)
+			if err != nil {
+				return err
+			}
+			if err = broker.Serve(); err != nil {
+				return err
+			}
+			defer broker.Close()
+		case config.ConnectorForward:
+			var routes []forward.Route
+			for _, r := range conn.Routes {
+				routes = append(routes, forward.Route{Pattern: r.Match, WAL: wals[r.Log]})
+			}
+			l, err := net.Listen("tcp", conn.Listen)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			go func() { errc <- forward.NewReceiver(routes, logger).Serve(l) }()
+		case config.ConnectorRemoteWrite:
+			r := remotewrite.NewReceiver(wals[conn.Log], conn.FlushInterval, conn.MaxBatchBytes)
+			defer r.Close()
+			receivers[i] = r
+			l, err := net.Listen("tcp", conn.Listen)
+			if err != nil {
+				return err
+			}
+			httpServer := &http.Server{Handler: r}
+			defer httpServer.Close()
+			go func() { errc <- httpServer.Serve(l) }()
+		}
+		logger.Info("connector started", "type", conn.Type, "listen", conn.Listen)
+	}
+
+	if c.Server != nil {
+		l, err := net.Listen("tcp", c.Server.Listen)
+		if err != nil {
+			return err
+		}
+		httpServer := &http.Server{Handler: server.New(logs, logger)}
+		defer httpServer.Close()
+		go func() { errc <- httpServer.Serve(l) }()
+		logger.Info("server started", "listen", c.Server.Listen)
+	}
+
+	go watcher.Run(ctx, *interval, func(c *config.Config) {
+		lvl, _ := c.Level()
+		level.Set(lvl)
+		for i, r := range receivers {
+			if r != nil {
+				r.SetBatching(c.Connectors[i].FlushInterval, c.Connectors[i].MaxBatchBytes)
+			}
+		}
+		logger.Info("config reloaded")
+	}, func(err error) {
+		logger.Error("config reload rejected", "err", err)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
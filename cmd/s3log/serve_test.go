@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/config"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+// connectMQTT connects to addr and returns the connection and the return
+// code of the CONNACK
+func connectMQTT(t *testing.T, addr, username, password string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	connect := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: "test-" + username,
+			UsernameFlag:     username != "",
+			Username:         []byte(username),
+			PasswordFlag:     password != "",
+			Password:         []byte(password),
+		},
+	}
+	var buf bytes.Buffer
+	if err = connect.ConnectEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	typ, body := readMQTTPacket(t, conn)
+	if typ != packets.Connack || len(body) != 2 {
+		t.Fatalf("expected CONNACK, got packet type %d", typ)
+	}
+	return conn, body[1]
+}
+
+func readMQTTPacket(t *testing.T, conn net.Conn) (byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	header, err := r.ReadByte()
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	// every packet in this test is shorter than 128 bytes
+	length, err := r.ReadByte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return header >> 4, body
+}
+
+func TestMQTTConnectorAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	wal := &waltest.MemWAL{}
+	conn := config.ConnectorConfig{
+		Type:   config.ConnectorMQTT,
+		Listen: addr,
+		Routes: []config.RouteConfig{{Match: "#", Log: "events"}},
+		Auth:   config.AuthConfig{Users: []config.UserConfig{{Username: "sensors", Password: "secret"}}},
+	}
+	server, err := newMQTTServer("mqtt-0", conn, map[string]s3_log.WAL{"events": wal}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, tt := range []struct{ username, password string }{
+		{"", ""},
+		{"sensors", "wrong"},
+		{"nobody", "secret"},
+	} {
+		if _, code := connectMQTT(t, addr, tt.username, tt.password); code == packets.CodeSuccess.Code {
+			t.Errorf("expected %q with password %q to be turned away", tt.username, tt.password)
+		}
+	}
+
+	c, code := connectMQTT(t, addr, "sensors", "secret")
+	if code != packets.CodeSuccess.Code {
+		t.Fatalf("expected configured user to connect, got return code %d", code)
+	}
+	publish := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "kitchen/temp",
+		Payload:     []byte("21.5"),
+		PacketID:    1,
+	}
+	var buf bytes.Buffer
+	if err = publish.PublishEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Write(buf.Bytes())
+	if typ, _ := readMQTTPacket(t, c); typ != packets.Puback {
+		t.Fatalf("expected PUBACK, got packet type %d", typ)
+	}
+	if _, err = wal.Read(context.Background(), 1); err != nil {
+		t.Errorf("expected publish to be in the log: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// verifyState is what -checkpoint stores: the progress of the scan and what
+// it found so far
+type verifyState struct {
+	Checkpoint s3_log.ScanCheckpoint `json:"checkpoint"`
+	Tampered   []uint64              `json:"tampered"`
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var lf logFlags
+	lf.register(fs)
+	checkpoint := fs.String("checkpoint", "", "file to save progress to and resume from")
+	parallelism := fs.Int("parallelism", 8, "number of key ranges listed at once")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: s3log verify [flags]")
+		fmt.Fprintln(fs.Output(), "prints the offsets whose object was overwritten or deleted, in a bucket with versioning enabled")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	wal, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+	var state verifyState
+	resumed := false
+	if *checkpoint != "" {
+		data, err := os.ReadFile(*checkpoint)
+		if err == nil {
+			if err = json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("failed to decode checkpoint: %w", err)
+			}
+			resumed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !resumed {
+		if state.Checkpoint, err = wal.PlanScan(ctx, *parallelism); err != nil {
+			return err
+		}
+	}
+
+	var found []uint64
+	opts := s3_log.ScanOptions{Parallelism: *parallelism}
+	if *checkpoint != "" {
+		opts.Checkpoint = func(cp s3_log.ScanCheckpoint) error {
+			state.Checkpoint = cp
+			state.Tampered, found = append(state.Tampered, found...), nil
+			return saveJSON(*checkpoint, state)
+		}
+	}
+	err = wal.VerifyVersionsFrom(ctx, &state.Checkpoint, opts, func(offsets []uint64) error {
+		found = append(found, offsets...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tampered := append(state.Tampered, found...)
+	slices.Sort(tampered)
+	for _, offset := range slices.Compact(tampered) {
+		fmt.Println(offset)
+	}
+	return nil
+}
+
+// saveJSON replaces path atomically, so that an interruption never leaves a
+// half written file behind
+func saveJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
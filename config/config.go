@@ -0,0 +1,335 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrRestartRequired = errors.New("structural change requires a restart")
+
+// Config is the configuration shared by the CLI, servers and connectors. A
+// file looks like
+//
+//	log_level: info
+//	logs:
+//	  metrics:
+//	    bucket: ${S3LOG_BUCKET}
+//	    prefix: metrics
+//	    endpoint: ${S3_ENDPOINT:-}
+//	connectors:
+//	  - type: remotewrite
+//	    listen: :9201
+//	    log: metrics
+//	    flush_interval: 1s
+//	    max_batch_bytes: 1048576
+//	server:
+//	  listen: :8080
+//
+// ${VAR} in a value is replaced by the environment variable VAR, which must
+// be set, ${VAR:-default} falls back to default, and $$ is a literal $.
+//
+// The log level and the batching of remote-write connectors can be changed
+// while running, see Watcher. Everything else is structural and needs a
+// restart.
+type Config struct {
+	LogLevel   string               `yaml:"log_level"`
+	Logs       map[string]LogConfig `yaml:"logs"`
+	Connectors []ConnectorConfig    `yaml:"connectors"`
+	// Server serves the logs over HTTP, nil for none
+	Server *ServerConfig `yaml:"server"`
+}
+
+type LogConfig struct {
+	Bucket   string `yaml:"bucket"`
+	Prefix   string `yaml:"prefix"`
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	// Versioned opens the log with NewVersionedS3WAL
+	Versioned bool `yaml:"versioned"`
+}
+
+const (
+	ConnectorMQTT        = "mqtt"
+	ConnectorForward     = "forward"
+	ConnectorRemoteWrite = "remotewrite"
+)
+
+type ConnectorConfig struct {
+	Type   string `yaml:"type"`
+	Listen string `yaml:"listen"`
+	// Routes map MQTT topic filters or Fluent tag patterns to logs
+	Routes []RouteConfig `yaml:"routes"`
+	// Log is where a remote-write connector writes
+	Log           string        `yaml:"log"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	MaxBatchBytes int           `yaml:"max_batch_bytes"`
+	// Auth is who may connect to an MQTT connector
+	Auth AuthConfig `yaml:"auth"`
+}
+
+// AuthConfig lets clients of an MQTT connector in if they log in as one of
+// Users, or without credentials if AllowAnonymous is set. One of the two is
+// required, so that a connector does not silently turn every client away:
+//
+//	auth:
+//	  users:
+//	    - username: sensors
+//	      password: ${MQTT_PASSWORD}
+type AuthConfig struct {
+	AllowAnonymous bool         `yaml:"allow_anonymous"`
+	Users          []UserConfig `yaml:"users"`
+}
+
+type UserConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ServerConfig is the HTTP server, see package server. Servers that share
+// logs elect an owner per log that takes all appends when Advertise is set
+// to the URL the other servers reach this one at:
+//
+//	server:
+//	  listen: :8080
+//	  advertise: http://10.0.0.1:8080
+//	  lease_ttl: 10s
+type ServerConfig struct {
+	Listen    string        `yaml:"listen"`
+	Advertise string        `yaml:"advertise"`
+	LeaseTTL  time.Duration `yaml:"lease_ttl"`
+}
+
+type RouteConfig struct {
+	Match string `yaml:"match"`
+	Log   string `yaml:"log"`
+}
+
+// Load reads and validates the config file at path.
+func Load(path string) (*Config, error) {
+	c, _, err := load(path)
+	return c, err
+}
+
+// load returns the config at path along with the contents of the file
+func load(path string) (*Config, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := Parse(data, os.LookupEnv)
+	if err != nil {
+		return nil, data, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, data, nil
+}
+
+// Parse decodes and validates a config, substituting variables with lookup.
+func Parse(data []byte, lookup func(string) (string, bool)) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	// substitute in the parsed values rather than the text, so that a value
+	// cannot change the structure of the document
+	if err := substitute(&root, lookup); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(&buf)
+	dec.KnownFields(true)
+	var c Config
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+var variable = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+func substitute(n *yaml.Node, lookup func(string) (string, bool)) error {
+	if n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "$") {
+		var err error
+		n.Value = variable.ReplaceAllStringFunc(n.Value, func(m string) string {
+			if m == "$$" {
+				return "$"
+			}
+			sub := variable.FindStringSubmatch(m)
+			if v, ok := lookup(sub[1]); ok {
+				return v
+			}
+			if sub[2] != "" {
+				return sub[3]
+			}
+			if err == nil {
+				err = fmt.Errorf("line %d: environment variable %s is not set", n.Line, sub[1])
+			}
+			return ""
+		})
+		if err != nil {
+			return err
+		}
+		// the value is a string no matter what the variable held, unless
+		// the field it goes into says otherwise
+		n.Tag = ""
+		n.Style = 0
+	}
+	for _, child := range n.Content {
+		if err := substitute(child, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that every required field is set and that connectors
+// refer to logs that exist.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	if _, err := c.Level(); err != nil {
+		fail("log_level", "%v", err)
+	}
+	names := make([]string, 0, len(c.Logs))
+	for name := range c.Logs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		l := c.Logs[name]
+		if l.Bucket == "" {
+			fail("logs."+name+".bucket", "required")
+		}
+		if l.Prefix == "" {
+			fail("logs."+name+".prefix", "required")
+		}
+	}
+	checkLog := func(path, log string) {
+		if log == "" {
+			fail(path, "required")
+		} else if _, ok := c.Logs[log]; !ok {
+			fail(path, "no log named %q", log)
+		}
+	}
+	for i, conn := range c.Connectors {
+		path := fmt.Sprintf("connectors[%d]", i)
+		if conn.Listen == "" {
+			fail(path+".listen", "required")
+		}
+		if conn.Type == ConnectorMQTT {
+			validateAuth(path+".auth", conn.Auth, fail)
+		} else if conn.Auth.AllowAnonymous || len(conn.Auth.Users) > 0 {
+			fail(path+".auth", "only supported by mqtt connectors")
+		}
+		switch conn.Type {
+		case ConnectorMQTT, ConnectorForward:
+			if len(conn.Routes) == 0 {
+				fail(path+".routes", "at least one route is required")
+			}
+			for j, r := range conn.Routes {
+				if r.Match == "" {
+					fail(fmt.Sprintf("%s.routes[%d].match", path, j), "required")
+				}
+				checkLog(fmt.Sprintf("%s.routes[%d].log", path, j), r.Log)
+			}
+		case ConnectorRemoteWrite:
+			checkLog(path+".log", conn.Log)
+			if conn.FlushInterval <= 0 {
+				fail(path+".flush_interval", "must be positive")
+			}
+			if conn.MaxBatchBytes <= 0 {
+				fail(path+".max_batch_bytes", "must be positive")
+			}
+		case "":
+			fail(path+".type", "required")
+		default:
+			fail(path+".type", "unknown connector %q, expected mqtt, forward or remotewrite", conn.Type)
+		}
+	}
+	if s := c.Server; s != nil {
+		if s.Listen == "" {
+			fail("server.listen", "required")
+		}
+		if s.Advertise != "" && s.LeaseTTL <= 0 {
+			fail("server.lease_ttl", "must be positive when advertise is set")
+		}
+		if s.Advertise == "" && s.LeaseTTL != 0 {
+			fail("server.lease_ttl", "requires advertise")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateAuth(path string, auth AuthConfig, fail func(path, format string, args ...any)) {
+	if !auth.AllowAnonymous && len(auth.Users) == 0 {
+		fail(path, "set allow_anonymous or add at least one user")
+	}
+	seen := make(map[string]bool, len(auth.Users))
+	for i, u := range auth.Users {
+		userPath := fmt.Sprintf("%s.users[%d]", path, i)
+		if u.Username == "" {
+			fail(userPath+".username", "required")
+		} else if seen[u.Username] {
+			fail(userPath+".username", "duplicate user %q", u.Username)
+		}
+		seen[u.Username] = true
+		if u.Password == "" {
+			fail(userPath+".password", "required")
+		}
+	}
+}
+
+// Level returns the log level, info if none is set.
+func (c *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	if c.LogLevel == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// CheckReload returns ErrRestartRequired if going from old to c changes
+// anything but the settings that can be applied while running.
+func (c *Config) CheckReload(old *Config) error {
+	strip := func(c *Config) Config {
+		s := *c
+		s.LogLevel = ""
+		s.Connectors = slices.Clone(c.Connectors)
+		for i := range s.Connectors {
+			s.Connectors[i].FlushInterval = 0
+			s.Connectors[i].MaxBatchBytes = 0
+		}
+		return s
+	}
+	a, b := strip(old), strip(c)
+	if !reflect.DeepEqual(a.Logs, b.Logs) && (len(a.Logs) > 0 || len(b.Logs) > 0) {
+		return fmt.Errorf("%w: logs changed", ErrRestartRequired)
+	}
+	if !reflect.DeepEqual(a.Connectors, b.Connectors) && (len(a.Connectors) > 0 || len(b.Connectors) > 0) {
+		return fmt.Errorf("%w: connectors changed", ErrRestartRequired)
+	}
+	if !reflect.DeepEqual(a.Server, b.Server) {
+		return fmt.Errorf("%w: server changed", ErrRestartRequired)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sample = `
+log_level: debug
+logs:
+  metrics:
+    bucket: ${BUCKET}
+    prefix: metrics
+    endpoint: ${ENDPOINT:-http://127.0.0.1:9000}
+    versioned: ${VERSIONED}
+  events:
+    bucket: ${BUCKET}
+    prefix: events
+connectors:
+  - type: remotewrite
+    listen: :9201
+    log: metrics
+    flush_interval: 1s
+    max_batch_bytes: 1048576
+  - type: forward
+    listen: :24224
+    routes:
+      - match: app.**
+        log: events
+server:
+  listen: :8080
+`
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(sample), env(map[string]string{"BUCKET": "prod", "VERSIONED": "true"}))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	metrics := c.Logs["metrics"]
+	if metrics.Bucket != "prod" || metrics.Endpoint != "http://127.0.0.1:9000" || !metrics.Versioned {
+		t.Errorf("unexpected log config %+v", metrics)
+	}
+	rw := c.Connectors[0]
+	if rw.FlushInterval != time.Second || rw.MaxBatchBytes != 1<<20 {
+		t.Errorf("unexpected connector config %+v", rw)
+	}
+	if c.Connectors[1].Routes[0].Match != "app.**" {
+		t.Errorf("unexpected routes %+v", c.Connectors[1].Routes)
+	}
+
+	if _, err = Parse([]byte(sample), env(map[string]string{"VERSIONED": "true"})); err == nil || !strings.Contains(err.Error(), "BUCKET is not set") {
+		t.Errorf("expected an error for the missing variable, got %v", err)
+	}
+}
+
+func TestSubstitutionKeepsStructure(t *testing.T) {
+	doc := `
+logs:
+  l:
+    bucket: "${BUCKET}"
+    prefix: a$$b
+`
+	c, err := Parse([]byte(doc), env(map[string]string{"BUCKET": "x\nprefix: injected"}))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	l := c.Logs["l"]
+	if l.Bucket != "x\nprefix: injected" || l.Prefix != "a$b" {
+		t.Errorf("expected values to be substituted literally, got %+v", l)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	doc := `
+log_level: loud
+logs:
+  l:
+    bucket: b
+connectors:
+  - type: remotewrite
+    listen: :9201
+    log: missing
+  - type: kafka
+    listen: :9092
+  - type: mqtt
+    listen: :1883
+    routes:
+      - match: "#"
+        log: l
+  - type: mqtt
+    listen: :1884
+    routes:
+      - match: "#"
+        log: l
+    auth:
+      users:
+        - username: a
+          password: secret
+        - username: a
+  - type: forward
+    listen: :24224
+    routes:
+      - match: "**"
+        log: l
+    auth:
+      allow_anonymous: true
+server:
+  lease_ttl: 10s
+`
+	_, err := Parse([]byte(doc), env(nil))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"log_level:",
+		"logs.l.prefix: required",
+		`connectors[0].log: no log named "missing"`,
+		"connectors[0].flush_interval: must be positive",
+		`connectors[1].type: unknown connector "kafka"`,
+		"connectors[2].auth: set allow_anonymous or add at least one user",
+		`connectors[3].auth.users[1].username: duplicate user "a"`,
+		"connectors[3].auth.users[1].password: required",
+		"connectors[4].auth: only supported by mqtt connectors",
+		"server.listen: required",
+		"server.lease_ttl: requires advertise",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+
+	if _, err = Parse([]byte("logs:\n  l:\n    bucket: b\n    prefix: p\n    bukket: typo\n"), env(nil)); err == nil || !strings.Contains(err.Error(), "bukket") {
+		t.Errorf("expected unknown fields to be rejected, got %v", err)
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	vars := env(map[string]string{"BUCKET": "prod", "VERSIONED": "false"})
+	old, err := Parse([]byte(sample), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuned := strings.NewReplacer("debug", "warn", "flush_interval: 1s", "flush_interval: 5s").Replace(sample)
+	c, err := Parse([]byte(tuned), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CheckReload(old); err != nil {
+		t.Errorf("expected log level and batching to be reloadable, got %v", err)
+	}
+
+	moved := strings.Replace(sample, ":9201", ":9202", 1)
+	if c, err = Parse([]byte(moved), vars); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CheckReload(old); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("expected ErrRestartRequired for a new listen address, got %v", err)
+	}
+
+	moved = strings.Replace(sample, ":8080", ":8081", 1)
+	if c, err = Parse([]byte(moved), vars); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CheckReload(old); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("expected ErrRestartRequired for a new server address, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// Watcher reloads a config file when it changes. A reload is only taken if
+// the new config is valid and differs from the current one in settings that
+// can change while running; otherwise the current config stays and the
+// error is reported.
+type Watcher struct {
+	path string
+
+	mu      sync.Mutex
+	current *Config
+	data    []byte
+}
+
+// NewWatcher loads the config file at path.
+func NewWatcher(path string) (*Watcher, error) {
+	c, data, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{path: path, current: c, data: data}, nil
+}
+
+// Current returns the config in effect.
+func (w *Watcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Reload reads the file again and returns the new config if it changed, or
+// nil if it did not.
+func (w *Watcher) Reload() (*Config, error) {
+	c, data, err := load(w.path)
+	if data == nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if bytes.Equal(data, w.data) {
+		return nil, nil
+	}
+	// a rejected file is not looked at again until it changes
+	w.data = data
+	if err != nil {
+		return nil, err
+	}
+	if err = c.CheckReload(w.current); err != nil {
+		return nil, err
+	}
+	w.current = c
+	return c, nil
+}
+
+// Run checks the file every interval until ctx is done, calling apply with
+// every new config and onError with every rejected one.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, apply func(*Config), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c, err := w.Reload()
+		if err != nil {
+			onError(err)
+			continue
+		}
+		if c != nil {
+			apply(c)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Setenv("BUCKET", "prod")
+	t.Setenv("VERSIONED", "false")
+	path := filepath.Join(t.TempDir(), "s3log.yaml")
+	write := func(doc string) {
+		if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(sample)
+	w, err := NewWatcher(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if c, err := w.Reload(); c != nil || err != nil {
+		t.Errorf("expected no reload for an unchanged file, got %v, %v", c, err)
+	}
+
+	write(strings.Replace(sample, "prefix: events", "prefix: other", 1))
+	if _, err = w.Reload(); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("expected ErrRestartRequired, got %v", err)
+	}
+	write("logs: [")
+	if _, err = w.Reload(); err == nil {
+		t.Error("expected an invalid file to be rejected")
+	}
+	if w.Current().LogLevel != "debug" {
+		t.Errorf("expected the current config to stay, got %+v", w.Current())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan *Config, 1)
+	go w.Run(ctx, 10*time.Millisecond, func(c *Config) { applied <- c }, func(err error) {})
+	write(strings.Replace(sample, "debug", "error", 1))
+	select {
+	case c := <-applied:
+		if c.LogLevel != "error" || w.Current() != c {
+			t.Errorf("expected the new log level to be applied, got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+}
@@ -0,0 +1,206 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+var ErrGroupActive = errors.New("consumer group has active members")
+
+// Partition is a log a group consumes, named by how its offsets are committed.
+type Partition struct {
+	Name string
+	WAL  *s3_log.S3WAL
+}
+
+type PartitionStatus struct {
+	Partition   string
+	Committed   uint64 // next offset to consume, 0 if nothing was committed
+	CommittedAt time.Time
+	End         uint64 // next offset to be written
+	Lag         uint64
+}
+
+type MemberStatus struct {
+	Name          string
+	JoinedAt      time.Time
+	LastHeartbeat time.Time
+	Active        bool
+	Partitions    []string // partitions the member holds
+}
+
+type Description struct {
+	Group      string
+	Epoch      uint64
+	Partitions []PartitionStatus
+	Members    []MemberStatus
+}
+
+// end returns the offset after the last record of the partition
+func end(ctx context.Context, p Partition) (uint64, error) {
+	last, err := p.WAL.LastRecord(ctx)
+	if errors.Is(err, s3_log.ErrEmpty) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the end of partition %s: %w", p.Name, err)
+	}
+	return last.Offset + 1, nil
+}
+
+// Describe returns the committed offsets and lag of group in every partition,
+// and its members.
+func (c *Coordinator) Describe(ctx context.Context, group string, partitions []Partition) (*Description, error) {
+	state, etag, err := c.get(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if etag == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoGroup, group)
+	}
+	d := &Description{Group: group, Epoch: state.Epoch}
+	for _, p := range partitions {
+		end, err := end(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		commit := state.Offsets[p.Name]
+		d.Partitions = append(d.Partitions, PartitionStatus{
+			Partition:   p.Name,
+			Committed:   commit.Offset,
+			CommittedAt: commit.CommittedAt,
+			End:         end,
+			Lag:         end - min(max(commit.Offset, 1), end),
+		})
+	}
+	now := time.Now()
+	for name, m := range state.Members {
+		d.Members = append(d.Members, MemberStatus{
+			Name:          name,
+			JoinedAt:      m.JoinedAt,
+			LastHeartbeat: m.LastHeartbeat,
+			Active:        c.active(m, now),
+			Partitions:    state.Owned[name],
+		})
+	}
+	slices.SortFunc(d.Members, func(a, b MemberStatus) int {
+		if a.Name < b.Name {
+			return -1
+		}
+		if a.Name > b.Name {
+			return 1
+		}
+		return 0
+	})
+	return d, nil
+}
+
+type resetKind int
+
+const (
+	resetEarliest resetKind = iota
+	resetLatest
+	resetOffset
+	resetTime
+)
+
+// ResetTarget is where Reset moves a group to.
+type ResetTarget struct {
+	kind   resetKind
+	offset uint64
+	time   time.Time
+}
+
+// Earliest resets to the first record.
+func Earliest() ResetTarget {
+	return ResetTarget{kind: resetEarliest}
+}
+
+// Latest resets past the last record, so only new records are consumed.
+func Latest() ResetTarget {
+	return ResetTarget{kind: resetLatest}
+}
+
+// ToOffset resets to offset, capped at the end of each partition.
+func ToOffset(offset uint64) ResetTarget {
+	return ResetTarget{kind: resetOffset, offset: offset}
+}
+
+// ToTime resets to the first record written at or after t.
+func ToTime(t time.Time) ResetTarget {
+	return ResetTarget{kind: resetTime, time: t}
+}
+
+func (t ResetTarget) resolve(ctx context.Context, p Partition) (uint64, error) {
+	end, err := end(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	switch t.kind {
+	case resetEarliest:
+		return 1, nil
+	case resetLatest:
+		return end, nil
+	case resetOffset:
+		return min(max(t.offset, 1), end), nil
+	}
+	// records are written in offset order, so their modification times only
+	// go up, at the one second precision of S3
+	var searchErr error
+	offset := 1 + uint64(sort.Search(int(end-1), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		info, err := p.WAL.HeadRecord(ctx, uint64(i)+1)
+		if err != nil {
+			searchErr = fmt.Errorf("failed to head offset %d of partition %s: %w", i+1, p.Name, err)
+			return true
+		}
+		return !info.LastModified.Before(t.time)
+	}))
+	return offset, searchErr
+}
+
+// Reset moves the committed offsets of group in every partition to target.
+// The group must have no active members, unless force is set. Either way the
+// epoch of the group is bumped and its members are removed, which fences
+// members that are still around: their commits fail with ErrFenced until they
+// rejoin and pick up the new offsets.
+func (c *Coordinator) Reset(ctx context.Context, group string, partitions []Partition, target ResetTarget, force bool) (map[string]uint64, error) {
+	offsets := make(map[string]uint64, len(partitions))
+	for _, p := range partitions {
+		offset, err := target.resolve(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		offsets[p.Name] = offset
+	}
+	_, err := c.update(ctx, group, false, func(s *State) error {
+		now := time.Now()
+		if !force {
+			for name, m := range s.Members {
+				if c.active(m, now) {
+					return fmt.Errorf("%w: %s is active, stop it or force the reset", ErrGroupActive, name)
+				}
+			}
+		}
+		s.Epoch++
+		clear(s.Members)
+		clear(s.Target)
+		clear(s.Owned)
+		for name, offset := range offsets {
+			s.Offsets[name] = Commit{Offset: offset, CommittedAt: now}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
@@ -0,0 +1,273 @@
+package consumergroup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var (
+	ErrNoGroup  = errors.New("no such consumer group")
+	ErrNotOwner = errors.New("partition is owned by another member")
+	// ErrFenced is returned to a member whose epoch is older than the
+	// group's, because the group was reset under it or it was expelled. It
+	// must rejoin and read its offsets again.
+	ErrFenced = errors.New("member is fenced")
+)
+
+// State is what is stored for a group: the committed offsets per partition
+// and the members with their last heartbeat. Epoch is bumped by every
+// change that invalidates what members think they own, which fences them.
+//
+// Groups that rebalance with a Consumer also keep the assignment: Target is
+// what the strategy wants each member to have and Owned what each member
+// actually holds. A partition only moves to its new member once the old one
+// released it.
+type State struct {
+	Epoch   uint64              `json:"epoch"`
+	Offsets map[string]Commit   `json:"offsets"`
+	Members map[string]Member   `json:"members"`
+	Target  map[string][]string `json:"target,omitempty"`
+	Owned   map[string][]string `json:"owned,omitempty"`
+}
+
+// owner returns the member holding partition, if any
+func (s *State) owner(partition string) (string, bool) {
+	for m, partitions := range s.Owned {
+		if slices.Contains(partitions, partition) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+func (s *State) removeMember(member string) {
+	delete(s.Members, member)
+	delete(s.Target, member)
+	delete(s.Owned, member)
+}
+
+// Commit is the committed position of a group in a partition. Offset is the
+// next offset to consume, like the offsets of ReadPage cursors.
+type Commit struct {
+	Offset      uint64    `json:"offset"`
+	CommittedAt time.Time `json:"committed_at"`
+}
+
+type Member struct {
+	JoinedAt      time.Time `json:"joined_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+// Coordinator keeps the state of the consumer groups of a log in objects
+// next to it, at prefix.groups/<group>, updated with conditional puts on
+// their ETag like Lease. A member that has not sent a heartbeat within the
+// session timeout is considered gone.
+type Coordinator struct {
+	client         *s3.Client
+	bucketName     string
+	prefix         string
+	sessionTimeout time.Duration
+}
+
+func NewCoordinator(client *s3.Client, bucketName, prefix string, sessionTimeout time.Duration) *Coordinator {
+	return &Coordinator{
+		client:         client,
+		bucketName:     bucketName,
+		prefix:         prefix,
+		sessionTimeout: sessionTimeout,
+	}
+}
+
+func (c *Coordinator) groupsPrefix() string {
+	// outside of `prefix/`, so that listing the log does not see it
+	return c.prefix + ".groups/"
+}
+
+func (c *Coordinator) get(ctx context.Context, group string) (State, string, error) {
+	result, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(c.groupsPrefix() + group),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return State{}, "", nil
+		}
+		return State{}, "", fmt.Errorf("failed to get group from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return State{}, "", fmt.Errorf("failed to read group body: %w", err)
+	}
+	var state State
+	if err = json.Unmarshal(data, &state); err != nil {
+		return State{}, "", fmt.Errorf("failed to decode group %s: %w", group, err)
+	}
+	return state, aws.ToString(result.ETag), nil
+}
+
+// update applies fn to the state of group and stores it, retrying when
+// someone else updated the group in the meantime. A missing group is only
+// created if create is set.
+func (c *Coordinator) update(ctx context.Context, group string, create bool, fn func(*State) error) (State, error) {
+	for {
+		state, etag, err := c.get(ctx, group)
+		if err != nil {
+			return State{}, err
+		}
+		if etag == "" && !create {
+			return State{}, fmt.Errorf("%w: %s", ErrNoGroup, group)
+		}
+		if state.Offsets == nil {
+			state.Offsets = make(map[string]Commit)
+		}
+		if state.Members == nil {
+			state.Members = make(map[string]Member)
+		}
+		if state.Target == nil {
+			state.Target = make(map[string][]string)
+		}
+		if state.Owned == nil {
+			state.Owned = make(map[string][]string)
+		}
+		if err = fn(&state); err != nil {
+			return State{}, err
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return State{}, fmt.Errorf("failed to encode group: %w", err)
+		}
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(c.bucketName),
+			Key:    aws.String(c.groupsPrefix() + group),
+			Body:   bytes.NewReader(data),
+		}
+		if etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = aws.String(etag)
+		}
+		_, err = c.client.PutObject(ctx, input)
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return State{}, fmt.Errorf("failed to put group to S3: %w", err)
+		}
+		return state, nil
+	}
+}
+
+// active reports whether a member has sent a heartbeat recently enough
+func (c *Coordinator) active(m Member, now time.Time) bool {
+	return now.Sub(m.LastHeartbeat) < c.sessionTimeout
+}
+
+// Join adds member to group, creating the group if needed, and returns the
+// epoch the member must pass along with its heartbeats and commits.
+func (c *Coordinator) Join(ctx context.Context, group, member string) (uint64, error) {
+	state, err := c.update(ctx, group, true, func(s *State) error {
+		now := time.Now()
+		m, ok := s.Members[member]
+		if !ok {
+			m.JoinedAt = now
+		}
+		m.LastHeartbeat = now
+		s.Members[member] = m
+		return nil
+	})
+	return state.Epoch, err
+}
+
+// Heartbeat keeps member in group. It returns ErrFenced if the member is no
+// longer part of the group at epoch.
+func (c *Coordinator) Heartbeat(ctx context.Context, group, member string, epoch uint64) error {
+	_, err := c.update(ctx, group, false, func(s *State) error {
+		m, ok := s.Members[member]
+		if !ok || s.Epoch != epoch {
+			return ErrFenced
+		}
+		m.LastHeartbeat = time.Now()
+		s.Members[member] = m
+		return nil
+	})
+	return err
+}
+
+// Leave removes member from group.
+func (c *Coordinator) Leave(ctx context.Context, group, member string) error {
+	_, err := c.update(ctx, group, false, func(s *State) error {
+		s.removeMember(member)
+		return nil
+	})
+	return err
+}
+
+// Commit records offset as the next offset group consumes from partition. It
+// returns ErrFenced if the member is no longer part of the group at epoch, so
+// that a member that missed a reset cannot overwrite it, and ErrNotOwner if
+// the partition is assigned to another member.
+func (c *Coordinator) Commit(ctx context.Context, group, member string, epoch uint64, partition string, offset uint64) error {
+	_, err := c.update(ctx, group, false, func(s *State) error {
+		if _, ok := s.Members[member]; !ok || s.Epoch != epoch {
+			return ErrFenced
+		}
+		if owner, ok := s.owner(partition); ok && owner != member {
+			return fmt.Errorf("%w: %s is owned by %s", ErrNotOwner, partition, owner)
+		}
+		s.Offsets[partition] = Commit{Offset: offset, CommittedAt: time.Now()}
+		return nil
+	})
+	return err
+}
+
+// Offsets returns the committed offsets of group.
+func (c *Coordinator) Offsets(ctx context.Context, group string) (map[string]Commit, error) {
+	state, etag, err := c.get(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if etag == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoGroup, group)
+	}
+	return state.Offsets, nil
+}
+
+// ListGroups returns the names of all groups of the log.
+func (c *Coordinator) ListGroups(ctx context.Context) ([]string, error) {
+	var groups []string
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucketName),
+		Prefix: aws.String(c.groupsPrefix()),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list groups from S3: %w", err)
+		}
+		for _, obj := range output.Contents {
+			groups = append(groups, strings.TrimPrefix(*obj.Key, c.groupsPrefix()))
+		}
+	}
+	slices.Sort(groups)
+	return groups, nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
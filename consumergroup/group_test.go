@@ -0,0 +1,144 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/s3test"
+)
+
+func setup(t *testing.T) (*s3.Client, string) {
+	client := s3test.Client()
+	return client, s3test.Bucket(t, client)
+}
+
+func TestGroupMembership(t *testing.T) {
+	client, bucketName := setup(t)
+	ctx := context.Background()
+	c := NewCoordinator(client, bucketName, "log", time.Minute)
+
+	epoch, err := c.Join(ctx, "billing", "worker-1")
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	if err = c.Heartbeat(ctx, "billing", "worker-1", epoch); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if err = c.Commit(ctx, "billing", "worker-1", epoch, "log", 5); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if err = c.Commit(ctx, "billing", "stranger", epoch, "log", 9); !errors.Is(err, ErrFenced) {
+		t.Errorf("expected ErrFenced for a member that never joined, got %v", err)
+	}
+	if err = c.Heartbeat(ctx, "nobody", "worker-1", epoch); !errors.Is(err, ErrNoGroup) {
+		t.Errorf("expected ErrNoGroup, got %v", err)
+	}
+	offsets, err := c.Offsets(ctx, "billing")
+	if err != nil || offsets["log"].Offset != 5 {
+		t.Errorf("expected committed offset 5, got %v, %v", offsets, err)
+	}
+
+	if _, err = c.Join(ctx, "audit", "worker-1"); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	groups, err := c.ListGroups(ctx)
+	if err != nil || fmt.Sprint(groups) != "[audit billing]" {
+		t.Errorf("expected [audit billing], got %v, %v", groups, err)
+	}
+
+	if err = c.Leave(ctx, "billing", "worker-1"); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	if err = c.Heartbeat(ctx, "billing", "worker-1", epoch); !errors.Is(err, ErrFenced) {
+		t.Errorf("expected ErrFenced after leaving, got %v", err)
+	}
+}
+
+func TestDescribeAndReset(t *testing.T) {
+	client, bucketName := setup(t)
+	ctx := context.Background()
+	c := NewCoordinator(client, bucketName, "orders", time.Minute)
+	wal := s3_log.NewS3WAL(client, bucketName, "orders")
+	partitions := []Partition{{Name: "orders", WAL: wal}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := wal.Append(ctx, []byte("before")); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	// S3 keeps modification times to the second
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append(ctx, []byte("after")); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	epoch, err := c.Join(ctx, "shipping", "worker-1")
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	if err = c.Commit(ctx, "shipping", "worker-1", epoch, "orders", 2); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	d, err := c.Describe(ctx, "shipping", partitions)
+	if err != nil {
+		t.Fatalf("failed to describe: %v", err)
+	}
+	p := d.Partitions[0]
+	if p.Committed != 2 || p.End != 6 || p.Lag != 4 || p.CommittedAt.IsZero() {
+		t.Errorf("unexpected partition status %+v", p)
+	}
+	if len(d.Members) != 1 || d.Members[0].Name != "worker-1" || !d.Members[0].Active {
+		t.Errorf("expected worker-1 to be active, got %+v", d.Members)
+	}
+
+	if _, err = c.Reset(ctx, "shipping", partitions, Earliest(), false); !errors.Is(err, ErrGroupActive) {
+		t.Fatalf("expected ErrGroupActive, got %v", err)
+	}
+	offsets, err := c.Reset(ctx, "shipping", partitions, Latest(), true)
+	if err != nil || offsets["orders"] != 6 {
+		t.Fatalf("expected forced reset to latest 6, got %v, %v", offsets, err)
+	}
+	// the reset fenced the member that was still running
+	if err = c.Commit(ctx, "shipping", "worker-1", epoch, "orders", 3); !errors.Is(err, ErrFenced) {
+		t.Errorf("expected ErrFenced after a forced reset, got %v", err)
+	}
+
+	// the group has no members now, so no force is needed
+	info, err := wal.HeadRecord(ctx, 3)
+	if err != nil {
+		t.Fatalf("failed to head record: %v", err)
+	}
+	for _, tc := range []struct {
+		target ResetTarget
+		want   uint64
+	}{
+		{Earliest(), 1},
+		{ToOffset(4), 4},
+		{ToOffset(100), 6},
+		{ToTime(info.LastModified), 3},
+		{ToTime(info.LastModified.Add(time.Hour)), 6},
+		{ToTime(time.Time{}), 1},
+	} {
+		offsets, err = c.Reset(ctx, "shipping", partitions, tc.target, false)
+		if err != nil || offsets["orders"] != tc.want {
+			t.Errorf("expected reset to %+v to give %d, got %v, %v", tc.target, tc.want, offsets, err)
+		}
+	}
+	d, err = c.Describe(ctx, "shipping", partitions)
+	if err != nil || d.Partitions[0].Committed != 1 || d.Partitions[0].Lag != 5 || len(d.Members) != 0 {
+		t.Errorf("unexpected description after resets: %+v, %v", d, err)
+	}
+
+	if _, err = c.Describe(ctx, "nobody", partitions); !errors.Is(err, ErrNoGroup) {
+		t.Errorf("expected ErrNoGroup, got %v", err)
+	}
+}
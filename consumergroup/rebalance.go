@@ -0,0 +1,173 @@
+package consumergroup
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Consumer is a member of a group that shares the partitions of a topic with
+// the other members. Membership works like a lease on the group object: a
+// member that misses heartbeats for the session timeout is expelled by the
+// next heartbeat of any other member, and its partitions are handed out
+// again. Whichever member sends a heartbeat recomputes the assignment with
+// the strategy, so there is no leader to elect.
+//
+// Partitions move in two steps. The old owner notices on a heartbeat that a
+// partition is no longer meant for it, calls OnRevoked so it can commit, and
+// releases it. The new owner picks it up on its next heartbeat and calls
+// OnAssigned. Until then nobody consumes the partition.
+type Consumer struct {
+	c          *Coordinator
+	group      string
+	member     string
+	partitions []string
+	strategy   Strategy
+	epoch      uint64
+	owned      []string
+
+	// OnAssigned is called with the partitions the member got, after it
+	// holds them, so it can read their committed offsets and start consuming
+	OnAssigned func(ctx context.Context, partitions []string) error
+	// OnRevoked is called with the partitions the member has to give up,
+	// before it releases them, so it can stop consuming and commit
+	OnRevoked func(ctx context.Context, partitions []string) error
+}
+
+// NewConsumer returns a member of group consuming from partitions, which
+// every member of the group must agree on.
+func (c *Coordinator) NewConsumer(group, member string, partitions []string, strategy Strategy) *Consumer {
+	partitions = slices.Clone(partitions)
+	slices.Sort(partitions)
+	return &Consumer{
+		c:          c,
+		group:      group,
+		member:     member,
+		partitions: slices.Compact(partitions),
+		strategy:   strategy,
+	}
+}
+
+// Join adds the member to the group and takes its share of the partitions
+// that are free.
+func (m *Consumer) Join(ctx context.Context) error {
+	epoch, err := m.c.Join(ctx, m.group, m.member)
+	if err != nil {
+		return err
+	}
+	m.epoch = epoch
+	m.owned = nil
+	return m.Heartbeat(ctx)
+}
+
+// Epoch returns the epoch to commit with.
+func (m *Consumer) Epoch() uint64 {
+	return m.epoch
+}
+
+// Partitions returns the partitions the member holds.
+func (m *Consumer) Partitions() []string {
+	return slices.Clone(m.owned)
+}
+
+// Commit commits offset for a partition the member holds.
+func (m *Consumer) Commit(ctx context.Context, partition string, offset uint64) error {
+	return m.c.Commit(ctx, m.group, m.member, m.epoch, partition, offset)
+}
+
+// Heartbeat keeps the member in the group and moves partitions as the
+// assignment changes, calling OnRevoked and OnAssigned. It must be called
+// well within the session timeout. On ErrFenced the member lost its
+// partitions and must Join again.
+func (m *Consumer) Heartbeat(ctx context.Context) error {
+	var revoke, acquired []string
+	state, err := m.c.update(ctx, m.group, false, func(s *State) error {
+		if _, ok := s.Members[m.member]; !ok || s.Epoch != m.epoch {
+			return ErrFenced
+		}
+		now := time.Now()
+		for name, member := range s.Members {
+			if name != m.member && !m.c.active(member, now) {
+				s.removeMember(name)
+			}
+		}
+		member := s.Members[m.member]
+		member.LastHeartbeat = now
+		s.Members[m.member] = member
+
+		members := make([]string, 0, len(s.Members))
+		for name := range s.Members {
+			members = append(members, name)
+		}
+		slices.Sort(members)
+		s.Target = m.strategy.Assign(members, m.partitions, s.Target)
+
+		// take the partitions meant for us that nobody holds any more
+		acquired = acquired[:0]
+		for _, p := range s.Target[m.member] {
+			if _, ok := s.owner(p); !ok {
+				s.Owned[m.member] = append(s.Owned[m.member], p)
+				acquired = append(acquired, p)
+			}
+		}
+		slices.Sort(s.Owned[m.member])
+		revoke = revoke[:0]
+		for _, p := range s.Owned[m.member] {
+			if !slices.Contains(s.Target[m.member], p) {
+				revoke = append(revoke, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.owned = state.Owned[m.member]
+
+	if len(revoke) > 0 {
+		if m.OnRevoked != nil {
+			if err := m.OnRevoked(ctx, revoke); err != nil {
+				return fmt.Errorf("failed to revoke %v: %w", revoke, err)
+			}
+		}
+		if err := m.release(ctx, revoke); err != nil {
+			return err
+		}
+	}
+	if len(acquired) > 0 && m.OnAssigned != nil {
+		if err := m.OnAssigned(ctx, acquired); err != nil {
+			return fmt.Errorf("failed to assign %v: %w", acquired, err)
+		}
+	}
+	return nil
+}
+
+func (m *Consumer) release(ctx context.Context, partitions []string) error {
+	state, err := m.c.update(ctx, m.group, false, func(s *State) error {
+		if _, ok := s.Members[m.member]; !ok || s.Epoch != m.epoch {
+			return ErrFenced
+		}
+		s.Owned[m.member] = slices.DeleteFunc(s.Owned[m.member], func(p string) bool {
+			return slices.Contains(partitions, p)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.owned = state.Owned[m.member]
+	return nil
+}
+
+// Leave gives up all partitions, calling OnRevoked first, and leaves the
+// group.
+func (m *Consumer) Leave(ctx context.Context) error {
+	if len(m.owned) > 0 && m.OnRevoked != nil {
+		if err := m.OnRevoked(ctx, m.Partitions()); err != nil {
+			return fmt.Errorf("failed to revoke %v: %w", m.owned, err)
+		}
+	}
+	m.owned = nil
+	return m.c.Leave(ctx, m.group, m.member)
+}
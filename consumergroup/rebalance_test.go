@@ -0,0 +1,94 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRebalance(t *testing.T) {
+	client, bucketName := setup(t)
+	ctx := context.Background()
+	c := NewCoordinator(client, bucketName, "topic", time.Second)
+	partitions := partitionNames(4)
+
+	var events []string
+	newConsumer := func(name string) *Consumer {
+		m := c.NewConsumer("indexer", name, partitions, RangeStrategy{})
+		m.OnAssigned = func(ctx context.Context, partitions []string) error {
+			events = append(events, fmt.Sprintf("%s+%v", name, partitions))
+			return nil
+		}
+		m.OnRevoked = func(ctx context.Context, revoked []string) error {
+			// commit before giving the partitions up, which needs us to
+			// still own them
+			for _, p := range revoked {
+				if err := m.Commit(ctx, p, 10); err != nil {
+					return err
+				}
+			}
+			events = append(events, fmt.Sprintf("%s-%v", name, revoked))
+			return nil
+		}
+		return m
+	}
+
+	a := newConsumer("a")
+	if err := a.Join(ctx); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	if fmt.Sprint(a.Partitions()) != "[p0 p1 p2 p3]" {
+		t.Errorf("expected a to own everything, got %v", a.Partitions())
+	}
+
+	b := newConsumer("b")
+	if err := b.Join(ctx); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	// a still holds everything, so b gets nothing until a lets go
+	if len(b.Partitions()) != 0 {
+		t.Errorf("expected b to wait for a, got %v", b.Partitions())
+	}
+	if err := b.Commit(ctx, "p2", 99); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected ErrNotOwner for a partition of a, got %v", err)
+	}
+	if err := a.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if err := b.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if fmt.Sprint(a.Partitions(), b.Partitions()) != "[p0 p1] [p2 p3]" {
+		t.Errorf("expected the partitions split, got %v and %v", a.Partitions(), b.Partitions())
+	}
+	offsets, err := c.Offsets(ctx, "indexer")
+	if err != nil || offsets["p2"].Offset != 10 || offsets["p3"].Offset != 10 {
+		t.Errorf("expected a to commit p2 and p3 on revocation, got %v, %v", offsets, err)
+	}
+
+	// a stops sending heartbeats and b takes over once it expired
+	time.Sleep(1100 * time.Millisecond)
+	if err := b.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if fmt.Sprint(b.Partitions()) != "[p0 p1 p2 p3]" {
+		t.Errorf("expected b to take over from the expired a, got %v", b.Partitions())
+	}
+	if err := a.Heartbeat(ctx); !errors.Is(err, ErrFenced) {
+		t.Errorf("expected the expired member to be fenced, got %v", err)
+	}
+
+	if err := b.Leave(ctx); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	want := "[a+[p0 p1 p2 p3] a-[p2 p3] b+[p2 p3] b+[p0 p1] b-[p0 p1 p2 p3]]"
+	if fmt.Sprint(events) != want {
+		t.Errorf("expected events %s, got %v", want, events)
+	}
+	d, err := c.Describe(ctx, "indexer", nil)
+	if err != nil || len(d.Members) != 0 {
+		t.Errorf("expected no members left, got %+v, %v", d, err)
+	}
+}
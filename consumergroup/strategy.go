@@ -0,0 +1,118 @@
+package consumergroup
+
+import (
+	"slices"
+)
+
+// Strategy divides partitions between the members of a group. members and
+// partitions are sorted, and previous is the assignment it returned last
+// time, for strategies that try to keep it. Every member that has
+// coordinator access computes the assignment, so it must be deterministic.
+type Strategy interface {
+	Assign(members, partitions []string, previous map[string][]string) map[string][]string
+}
+
+// RangeStrategy gives every member a contiguous range of partitions.
+type RangeStrategy struct{}
+
+func (RangeStrategy) Assign(members, partitions []string, previous map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	base, extra := len(partitions)/len(members), len(partitions)%len(members)
+	start := 0
+	for i, m := range members {
+		n := base
+		if i < extra {
+			n++
+		}
+		assignment[m] = slices.Clone(partitions[start : start+n])
+		start += n
+	}
+	return assignment
+}
+
+// RoundRobinStrategy deals the partitions out to the members one by one.
+type RoundRobinStrategy struct{}
+
+func (RoundRobinStrategy) Assign(members, partitions []string, previous map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	for i, p := range partitions {
+		m := members[i%len(members)]
+		assignment[m] = append(assignment[m], p)
+	}
+	return assignment
+}
+
+// StickyStrategy balances the partitions like the others, but moves as few
+// of them as possible from the previous assignment, so that fewer members
+// have to give up partitions when the group changes.
+type StickyStrategy struct{}
+
+func (StickyStrategy) Assign(members, partitions []string, previous map[string][]string) map[string][]string {
+	assignment := make(map[string][]string, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	base, extra := len(partitions)/len(members), len(partitions)%len(members)
+
+	// what each member still owns that still exists, each partition once
+	exists := make(map[string]bool, len(partitions))
+	for _, p := range partitions {
+		exists[p] = true
+	}
+	kept := make(map[string][]string, len(members))
+	taken := make(map[string]bool, len(partitions))
+	for _, m := range members {
+		for _, p := range previous[m] {
+			if exists[p] && !taken[p] {
+				kept[m] = append(kept[m], p)
+				taken[p] = true
+			}
+		}
+	}
+
+	limit := make(map[string]int, len(members))
+	for _, m := range members {
+		limit[m] = base
+		assignment[m] = slices.Clone(kept[m][:min(len(kept[m]), base)])
+	}
+	// the members that had more than their share keep one extra
+	for _, m := range members {
+		if extra > 0 && len(kept[m]) > base {
+			assignment[m] = append(assignment[m], kept[m][base])
+			limit[m] = base + 1
+			extra--
+		}
+	}
+	for _, m := range members {
+		if extra > 0 && limit[m] == base {
+			limit[m] = base + 1
+			extra--
+		}
+	}
+
+	assigned := make(map[string]bool, len(partitions))
+	for _, m := range members {
+		for _, p := range assignment[m] {
+			assigned[p] = true
+		}
+	}
+	var free []string
+	for _, p := range partitions {
+		if !assigned[p] {
+			free = append(free, p)
+		}
+	}
+	for _, m := range members {
+		n := min(limit[m]-len(assignment[m]), len(free))
+		assignment[m] = append(assignment[m], free[:n]...)
+		free = free[n:]
+		slices.Sort(assignment[m])
+	}
+	return assignment
+}
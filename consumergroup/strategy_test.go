@@ -0,0 +1,62 @@
+package consumergroup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func partitionNames(n int) []string {
+	var partitions []string
+	for i := 0; i < n; i++ {
+		partitions = append(partitions, fmt.Sprintf("p%d", i))
+	}
+	return partitions
+}
+
+func TestStrategies(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	partitions := partitionNames(7)
+	for _, tc := range []struct {
+		strategy Strategy
+		want     string
+	}{
+		{RangeStrategy{}, "map[a:[p0 p1 p2] b:[p3 p4] c:[p5 p6]]"},
+		{RoundRobinStrategy{}, "map[a:[p0 p3 p6] b:[p1 p4] c:[p2 p5]]"},
+		{StickyStrategy{}, "map[a:[p0 p1 p2] b:[p3 p4] c:[p5 p6]]"},
+	} {
+		got := fmt.Sprint(tc.strategy.Assign(members, partitions, nil))
+		if got != tc.want {
+			t.Errorf("%T: expected %s, got %s", tc.strategy, tc.want, got)
+		}
+		if got := fmt.Sprint(tc.strategy.Assign(nil, partitions, nil)); got != "map[]" {
+			t.Errorf("%T: expected no assignment without members, got %s", tc.strategy, got)
+		}
+	}
+}
+
+func TestStickyStrategy(t *testing.T) {
+	partitions := partitionNames(6)
+	previous := map[string][]string{
+		"a": {"p0", "p1"},
+		"b": {"p2", "p3"},
+		"c": {"p4", "p5"},
+	}
+
+	// c leaves: a and b keep what they have and split what c had
+	got := StickyStrategy{}.Assign([]string{"a", "b"}, partitions, previous)
+	if fmt.Sprint(got) != "map[a:[p0 p1 p4] b:[p2 p3 p5]]" {
+		t.Errorf("unexpected assignment after c left: %v", got)
+	}
+
+	// d joins: a and b give up one each, the rest stays
+	got = StickyStrategy{}.Assign([]string{"a", "b", "d"}, partitions, got)
+	if fmt.Sprint(got) != "map[a:[p0 p1] b:[p2 p3] d:[p4 p5]]" {
+		t.Errorf("unexpected assignment after d joined: %v", got)
+	}
+
+	// a partition removed from the topic and one added
+	got = StickyStrategy{}.Assign([]string{"a", "b", "d"}, []string{"p0", "p1", "p2", "p3", "p4", "p6"}, got)
+	if fmt.Sprint(got) != "map[a:[p0 p1] b:[p2 p3] d:[p4 p6]]" {
+		t.Errorf("unexpected assignment after partitions changed: %v", got)
+	}
+}
@@ -0,0 +1,186 @@
+package s3_log
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// cursorVersion 2 added the partition set, tokens of version 1 are still
+// accepted
+const cursorVersion = 2
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a log or topic that a paginated read resumes from.
+// Besides the next offset, or the next offset of every partition of a topic,
+// it carries the log it belongs to and the filter of the read, so that a
+// client cannot resume with a different filter or against a different log by
+// mistake. It is handed to clients as an opaque token, which holds everything
+// needed to resume and so survives server restarts.
+type Cursor struct {
+	// Log identifies the log, e.g. "bucket/prefix"
+	Log string
+	// Offset is the next offset to read, 0 is the same as 1
+	Offset uint64
+	// Filter is the filter expression of the read, empty for none. It is not
+	// interpreted here.
+	Filter string
+	// Partitions is the next offset to read in each partition of a topic, as
+	// returned by topic.Reader.Position, and nil for a single log
+	Partitions map[string]uint64
+}
+
+// Encode returns the cursor as an opaque, URL safe token.
+func (c Cursor) Encode() string {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64*3+len(c.Log)+len(c.Filter))
+	buf[0] = cursorVersion
+	buf = binary.AppendUvarint(buf, c.Offset)
+	buf = binary.AppendUvarint(buf, uint64(len(c.Log)))
+	buf = append(buf, c.Log...)
+	buf = binary.AppendUvarint(buf, uint64(len(c.Filter)))
+	buf = append(buf, c.Filter...)
+	// sorted, so that the same position always encodes to the same token
+	buf = binary.AppendUvarint(buf, uint64(len(c.Partitions)))
+	for _, name := range slices.Sorted(maps.Keys(c.Partitions)) {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, c.Partitions[name])
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeCursor parses a token returned by Encode and checks that it belongs
+// to log.
+func DecodeCursor(token string, log string) (Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) == 0 || buf[0] != 1 && buf[0] != cursorVersion {
+		return Cursor{}, ErrInvalidCursor
+	}
+	version := buf[0]
+	buf = buf[1:]
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return v, true
+	}
+	readString := func() (string, bool) {
+		size, ok := readUvarint()
+		if !ok || size > uint64(len(buf)) {
+			return "", false
+		}
+		s := string(buf[:size])
+		buf = buf[size:]
+		return s, true
+	}
+	var c Cursor
+	var ok bool
+	if c.Offset, ok = readUvarint(); !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if c.Log, ok = readString(); !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if c.Filter, ok = readString(); !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if version >= 2 {
+		n, ok := readUvarint()
+		// every partition takes at least two bytes, which bounds n
+		if !ok || n > uint64(len(buf))/2 {
+			return Cursor{}, ErrInvalidCursor
+		}
+		for i := uint64(0); i < n; i++ {
+			name, ok := readString()
+			if !ok {
+				return Cursor{}, ErrInvalidCursor
+			}
+			offset, ok := readUvarint()
+			if !ok {
+				return Cursor{}, ErrInvalidCursor
+			}
+			if c.Partitions == nil {
+				c.Partitions = make(map[string]uint64, n)
+			}
+			c.Partitions[name] = offset
+		}
+	}
+	if len(buf) != 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if c.Log != log {
+		return Cursor{}, fmt.Errorf("%w: cursor is for log %q, not %q", ErrInvalidCursor, c.Log, log)
+	}
+	return c, nil
+}
+
+// TailProber is a WAL that can find the offset of its last record without
+// reading it. Unlike LastRecord it leaves the WAL as it is, so it is safe to
+// call on a WAL that another goroutine appends to.
+type TailProber interface {
+	LastOffset(ctx context.Context) (uint64, error)
+}
+
+// ReadPage returns up to limit records at or after the cursor for which match
+// returns true, along with the cursor to read the next page from. A nil match
+// returns every record. Records skipped by match are not scanned again on the
+// next page. At the end of the log it returns the records found so far and a
+// cursor past the last record, so polling with it picks up new records. It
+// stops at the seal of a sealed log; ChainReader follows it into the
+// successor. The end of the log is found with LastOffset if wal is a
+// TailProber, so reading pages from a WAL that is also appended to is safe.
+func ReadPage(ctx context.Context, wal WAL, cursor Cursor, limit int, match func(Record) (bool, error)) ([]Record, Cursor, error) {
+	// the last record itself is only known if LastRecord found it
+	var last Record
+	var haveLast bool
+	if prober, ok := wal.(TailProber); ok {
+		offset, err := prober.LastOffset(ctx)
+		if err != nil {
+			return nil, cursor, err
+		}
+		last.Offset = offset
+	} else {
+		var err error
+		last, err = wal.LastRecord(ctx)
+		if err != nil && !errors.Is(err, ErrEmpty) {
+			return nil, cursor, err
+		}
+		haveLast = err == nil
+	}
+	if last.Offset == 0 {
+		return nil, cursor, nil
+	}
+
+	var records []Record
+	var err error
+	offset := max(cursor.Offset, 1)
+	for ; offset <= last.Offset && len(records) < limit; offset++ {
+		record := last
+		if offset != last.Offset || !haveLast {
+			if record, err = wal.Read(ctx, offset); err != nil {
+				cursor.Offset = offset
+				return records, cursor, fmt.Errorf("failed to read offset %d: %w", offset, err)
+			}
+		}
+		if match != nil {
+			ok, err := match(record)
+			if err != nil {
+				cursor.Offset = offset
+				return records, cursor, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		records = append(records, record)
+	}
+	cursor.Offset = offset
+	return records, cursor, nil
+}
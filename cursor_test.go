@@ -0,0 +1,138 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	c := Cursor{Log: "bucket/prefix", Offset: 42, Filter: `json.level == "error"`}
+	decoded, err := DecodeCursor(c.Encode(), "bucket/prefix")
+	if err != nil {
+		t.Fatalf("failed to decode cursor: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, c) {
+		t.Errorf("expected %+v, got %+v", c, decoded)
+	}
+	topic := Cursor{Log: "bucket/topic", Partitions: map[string]uint64{"0": 13, "0.0": 4, "0.1": 1}}
+	if decoded, err = DecodeCursor(topic.Encode(), "bucket/topic"); err != nil || !reflect.DeepEqual(decoded, topic) {
+		t.Errorf("expected %+v, got %+v, %v", topic, decoded, err)
+	}
+
+	// tokens from before the partition set still decode
+	v1 := []byte{1, 42, 13}
+	v1 = append(v1, "bucket/prefix"...)
+	v1 = append(v1, 0)
+	decoded, err = DecodeCursor(base64.RawURLEncoding.EncodeToString(v1), "bucket/prefix")
+	if err != nil || decoded.Offset != 42 || decoded.Partitions != nil {
+		t.Errorf("expected version 1 cursor at 42, got %+v, %v", decoded, err)
+	}
+	if _, err = DecodeCursor(c.Encode(), "bucket/other"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for another log, got %v", err)
+	}
+	for _, token := range []string{"", "not a cursor", c.Encode()[:5], c.Encode() + "AA"} {
+		if _, err = DecodeCursor(token, "bucket/prefix"); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected ErrInvalidCursor for %q, got %v", token, err)
+		}
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	cursor := Cursor{Log: "test"}
+	records, cursor, err := ReadPage(ctx, wal, cursor, 10, nil)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("expected empty page from empty WAL, got %v, %v", records, err)
+	}
+
+	for i := 0; i < 7; i++ {
+		if _, err = wal.Append(ctx, []byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	even := func(r Record) (bool, error) {
+		return r.Offset%2 == 0, nil
+	}
+
+	var got []uint64
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("pagination did not stop")
+		}
+		// resume from the token, as a client would
+		cursor, err = DecodeCursor(cursor.Encode(), "test")
+		if err != nil {
+			t.Fatalf("failed to decode cursor: %v", err)
+		}
+		records, cursor, err = ReadPage(ctx, wal, cursor, 2, even)
+		if err != nil {
+			t.Fatalf("failed to read page: %v", err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, r := range records {
+			if !bytes.Equal(r.Data, []byte(fmt.Sprintf("record-%d", r.Offset-1))) {
+				t.Errorf("unexpected data %q at offset %d", r.Data, r.Offset)
+			}
+			got = append(got, r.Offset)
+		}
+	}
+	if fmt.Sprint(got) != "[2 4 6]" {
+		t.Errorf("expected offsets [2 4 6], got %v", got)
+	}
+	if cursor.Offset != 8 {
+		t.Errorf("expected cursor past the tail at 8, got %d", cursor.Offset)
+	}
+
+	// new records show up when polling with the last cursor
+	if _, err = wal.Append(ctx, []byte("record-7")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if _, err = wal.Append(ctx, []byte("record-8")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	records, _, err = ReadPage(ctx, wal, cursor, 2, even)
+	if err != nil || len(records) != 1 || records[0].Offset != 8 {
+		t.Errorf("expected offset 8 after polling, got %v, %v", records, err)
+	}
+}
+
+func TestReadPageLeavesWriterAlone(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append(ctx, []byte(generateRandomStr())); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	other := NewS3WAL(wal.client, wal.bucketName, wal.prefix)
+	if _, err := other.LastRecord(ctx); err != nil {
+		t.Fatalf("failed to find the tail: %v", err)
+	}
+	if _, err := other.Seal(ctx, ""); err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	// paging through the writer must not move it past the seal marker
+	records, cursor, err := ReadPage(ctx, wal, Cursor{}, 10, nil)
+	if err != nil || len(records) != 3 || cursor.Offset != 4 {
+		t.Fatalf("expected 3 records up to the seal, got %d, %+v, %v", len(records), cursor, err)
+	}
+	if wal.length != 3 || wal.sealed {
+		t.Errorf("expected the writer at 3 and not sealed, got %d, %v", wal.length, wal.sealed)
+	}
+	if last, err := wal.LastOffset(ctx); err != nil || last != 3 {
+		t.Errorf("expected last offset 3, got %d, %v", last, err)
+	}
+}
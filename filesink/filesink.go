@@ -0,0 +1,255 @@
+package filesink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+const (
+	manifestName = "manifest.json"
+	tmpPrefix    = ".tmp-"
+)
+
+// File is a committed export file and the offsets it covers.
+type File struct {
+	Name  string `json:"name"`
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+type manifest struct {
+	Files []File `json:"files"`
+}
+
+// line is how a record is stored in an export file, one JSON object per line
+type line struct {
+	Offset uint64 `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+// Sink exports a log into files in a local directory such that every record
+// ends up in exactly one committed file, even across crashes. A file is
+// written under a temporary name and renamed into place, and then committed
+// by atomically replacing the manifest, which lists every committed file and
+// its offsets. Export files and temporary files not in the manifest are
+// uncommitted and are discarded when the sink is opened again.
+type Sink struct {
+	dir      string
+	wal      s3_log.WAL
+	manifest manifest
+}
+
+// Open opens the sink in dir, creating it if needed, and discards whatever
+// was left uncommitted by an earlier crash.
+func Open(dir string, wal s3_log.WAL) (*Sink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create sink directory: %w", err)
+	}
+	s := &Sink{dir: dir, wal: wal}
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &s.manifest); err != nil {
+			return nil, fmt.Errorf("failed to decode manifest: %w", err)
+		}
+	}
+	if err = s.discardUncommitted(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// discardUncommitted removes temporary files and export files missing from
+// the manifest. Anything else in the directory is not ours and is left alone.
+func (s *Sink) discardUncommitted() error {
+	committed := make(map[string]bool, len(s.manifest.Files))
+	for _, f := range s.manifest.Files {
+		committed[f.Name] = true
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list sink directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || committed[name] || !strings.HasPrefix(name, tmpPrefix) && !isExportFile(name) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return fmt.Errorf("failed to remove uncommitted file: %w", err)
+		}
+	}
+	return nil
+}
+
+func exportFileName(first, last uint64) string {
+	return fmt.Sprintf("%020d-%020d.ndjson", first, last)
+}
+
+func isExportFile(name string) bool {
+	base, ok := strings.CutSuffix(name, ".ndjson")
+	if !ok {
+		return false
+	}
+	a, b, ok := strings.Cut(base, "-")
+	if !ok {
+		return false
+	}
+	first, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return false
+	}
+	last, err := strconv.ParseUint(b, 10, 64)
+	return err == nil && name == exportFileName(first, last)
+}
+
+// LastCommitted returns the last offset in a committed file, or 0 if nothing
+// has been committed yet. Exports resume right after it.
+func (s *Sink) LastCommitted() uint64 {
+	if len(s.manifest.Files) == 0 {
+		return 0
+	}
+	return s.manifest.Files[len(s.manifest.Files)-1].Last
+}
+
+// Files returns the committed files, oldest first.
+func (s *Sink) Files() []File {
+	return append([]File(nil), s.manifest.Files...)
+}
+
+// Export writes the records after the last committed offset up to and
+// including to into a single file and commits it.
+func (s *Sink) Export(ctx context.Context, to uint64) (File, error) {
+	first := s.LastCommitted() + 1
+	if to < first {
+		return File{}, fmt.Errorf("nothing to export: last committed offset is %d", first-1)
+	}
+	f := File{
+		Name:  exportFileName(first, to),
+		First: first,
+		Last:  to,
+	}
+
+	// phase one: write the file under a temporary name and move it into place
+	tmpPath := filepath.Join(s.dir, tmpPrefix+f.Name)
+	if err := s.writeFile(ctx, tmpPath, first, to); err != nil {
+		os.Remove(tmpPath)
+		return File{}, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, f.Name)); err != nil {
+		return File{}, fmt.Errorf("failed to rename export file: %w", err)
+	}
+	// the file must be in place for good before the manifest points to it
+	if err := s.syncDir(); err != nil {
+		return File{}, err
+	}
+
+	// phase two: commit it by replacing the manifest
+	next := manifest{Files: append(s.Files(), f)}
+	if err := s.writeManifest(next); err != nil {
+		return File{}, err
+	}
+	s.manifest = next
+	return f, nil
+}
+
+func (s *Sink) writeFile(ctx context.Context, path string, first, last uint64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for offset := first; offset <= last; offset++ {
+		record, err := s.wal.Read(ctx, offset)
+		if err != nil {
+			return fmt.Errorf("failed to read offset %d: %w", offset, err)
+		}
+		if err = enc.Encode(line{Offset: record.Offset, Data: record.Data}); err != nil {
+			return fmt.Errorf("failed to write record: %w", err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync export file: %w", err)
+	}
+	return nil
+}
+
+func (s *Sink) writeManifest(m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	tmpPath := filepath.Join(s.dir, tmpPrefix+manifestName)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err = os.Rename(tmpPath, filepath.Join(s.dir, manifestName)); err != nil {
+		return fmt.Errorf("failed to commit manifest: %w", err)
+	}
+	return s.syncDir()
+}
+
+// syncDir makes renames in the sink directory durable
+func (s *Sink) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open sink directory: %w", err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync sink directory: %w", err)
+	}
+	return nil
+}
+
+// ReadFile returns the records stored in a committed export file.
+func ReadFile(path string) ([]s3_log.Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export file: %w", err)
+	}
+	defer file.Close()
+
+	var records []s3_log.Record
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var rec line
+		err = dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode record: %w", err)
+		}
+		records = append(records, s3_log.Record{Offset: rec.Offset, Data: rec.Data})
+	}
+}
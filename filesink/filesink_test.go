@@ -0,0 +1,94 @@
+package filesink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func TestSinkExactlyOnce(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	wal := &waltest.MemWAL{}
+	for i := 1; i <= 10; i++ {
+		wal.Append(ctx, []byte(fmt.Sprintf("record-%d", i)))
+	}
+
+	sink, err := Open(dir, wal)
+	if err != nil {
+		t.Fatalf("failed to open sink: %v", err)
+	}
+	if _, err = sink.Export(ctx, 4); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	// a failed export leaves nothing committed behind
+	wal.FailRead(7)
+	if _, err = sink.Export(ctx, 8); err == nil {
+		t.Fatal("expected export to fail, got nil")
+	}
+	wal.FailRead(0)
+
+	// simulate a crash between renaming a file into place and committing it
+	orphan := filepath.Join(dir, fmt.Sprintf("%020d-%020d.ndjson", 5, 10))
+	if err = os.WriteFile(orphan, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// files that are not the sink's own must survive
+	unrelated := filepath.Join(dir, "notes.txt")
+	if err = os.WriteFile(unrelated, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err = Open(dir, wal)
+	if err != nil {
+		t.Fatalf("failed to reopen sink: %v", err)
+	}
+	if _, err = os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected uncommitted file to be discarded, got %v", err)
+	}
+	if _, err = os.Stat(unrelated); err != nil {
+		t.Errorf("expected unrelated file to be kept, got %v", err)
+	}
+	if err = os.Remove(unrelated); err != nil {
+		t.Fatal(err)
+	}
+	if sink.LastCommitted() != 4 {
+		t.Fatalf("expected to resume after offset 4, got %d", sink.LastCommitted())
+	}
+	if _, err = sink.Export(ctx, 10); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	var offsets []uint64
+	for _, f := range sink.Files() {
+		records, err := ReadFile(filepath.Join(dir, f.Name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", f.Name, err)
+		}
+		for _, r := range records {
+			if want := fmt.Sprintf("record-%d", r.Offset); string(r.Data) != want {
+				t.Errorf("data mismatch at offset %d: expected %q, got %q", r.Offset, want, r.Data)
+			}
+			offsets = append(offsets, r.Offset)
+		}
+	}
+	if len(offsets) != 10 {
+		t.Fatalf("expected 10 records, got %d", len(offsets))
+	}
+	for i, offset := range offsets {
+		if offset != uint64(i+1) {
+			t.Errorf("expected offset %d at position %d, got %d", i+1, i, offset)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("expected manifest and 2 files, got %d entries", len(entries))
+	}
+}
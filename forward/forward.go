@@ -0,0 +1,409 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// EventTime is the Forward protocol's nanosecond timestamp, msgpack ext type 0.
+type EventTime struct {
+	time.Time
+}
+
+func init() {
+	msgpack.RegisterExt(0, (*EventTime)(nil))
+}
+
+func (t *EventTime) MarshalMsgpack() ([]byte, error) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(t.Nanosecond()))
+	return buf, nil
+}
+
+func (t *EventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid EventTime of %d bytes", len(b))
+	}
+	sec := binary.BigEndian.Uint32(b[:4])
+	nsec := binary.BigEndian.Uint32(b[4:])
+	t.Time = time.Unix(int64(sec), int64(nsec)).UTC()
+	return nil
+}
+
+// Route sends events whose tag matches Pattern to WAL. Patterns follow
+// Fluentd: `*` matches one tag part and `**` matches zero or more parts.
+type Route struct {
+	Pattern string
+	WAL     s3_log.WAL
+}
+
+const (
+	// maxBatchSize bounds the encoded events stored in one record. The
+	// events of a message that is larger are split over several records.
+	maxBatchSize = 1 << 20
+	// maxMessageSize bounds a single message as sent on the connection
+	maxMessageSize = 16 << 20
+	// maxDecompressedSize bounds the entries of a compressed message once
+	// decompressed, so that a small gzip bomb cannot exhaust memory
+	maxDecompressedSize = 64 << 20
+)
+
+var errTooLarge = errors.New("message is too large")
+
+// Event is a single event. A record holds a JSON array of the events of one
+// message, in the order they were sent.
+type Event struct {
+	Tag    string         `json:"tag"`
+	Time   time.Time      `json:"time"`
+	Record map[string]any `json:"record"`
+}
+
+// Receiver accepts the Fluent Forward protocol over TCP, as spoken by Fluent
+// Bit and Fluentd, and appends every event to the log its tag routes to. When
+// the client asks for an ack by sending a chunk id, the ack is only sent once
+// all events of the message are in S3. The events of a message are appended
+// together, as one record unless they exceed maxBatchSize. If an append
+// fails the connection is closed without an ack, so the client retries the
+// chunk. Delivery is at least once: when a message was split over several
+// records and a later one fails, the records already appended are appended
+// again by the retry, and readers that need exactly once must dedupe them.
+// Messages over maxMessageSize, or maxDecompressedSize once decompressed,
+// close the connection without an ack. Events whose tag matches no route
+// are dropped. Shared key handshakes are not supported.
+type Receiver struct {
+	routes []Route
+	locks  map[s3_log.WAL]*sync.Mutex
+	logger *slog.Logger
+}
+
+func NewReceiver(routes []Route, logger *slog.Logger) *Receiver {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	locks := make(map[s3_log.WAL]*sync.Mutex)
+	for _, r := range routes {
+		if _, ok := locks[r.WAL]; !ok {
+			locks[r.WAL] = &sync.Mutex{}
+		}
+	}
+	return &Receiver{routes: routes, locks: locks, logger: logger}
+}
+
+// Serve accepts connections on l until it is closed.
+func (r *Receiver) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := r.handle(conn); err != nil && !errors.Is(err, io.EOF) {
+				r.logger.Error("forward connection failed", "remote", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+func (r *Receiver) handle(conn net.Conn) error {
+	lr := &limitedReader{r: bufio.NewReader(conn)}
+	dec := msgpack.NewDecoder(lr)
+	enc := msgpack.NewEncoder(conn)
+	for {
+		var msg []any
+		lr.n = maxMessageSize
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, errTooLarge) {
+				return fmt.Errorf("message is over the limit of %d bytes", maxMessageSize)
+			}
+			return err
+		}
+		tag, events, option, err := decodeMessage(msg)
+		if err != nil {
+			return err
+		}
+		if err = r.appendEvents(tag, events); err != nil {
+			return err
+		}
+		if chunk, ok := option["chunk"]; ok {
+			if err = enc.Encode(map[string]any{"ack": chunk}); err != nil {
+				return fmt.Errorf("failed to send ack: %w", err)
+			}
+		}
+	}
+}
+
+func (r *Receiver) appendEvents(tag string, events []Event) error {
+	wal := r.route(tag)
+	if wal == nil || len(events) == 0 {
+		return nil
+	}
+	var batches [][]byte
+	var batch []byte
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		if len(batch) > 0 && len(batch)+len(data)+1 > maxBatchSize {
+			batches = append(batches, append(batch, ']'))
+			batch = nil
+		}
+		if len(batch) == 0 {
+			batch = append(batch, '[')
+		} else {
+			batch = append(batch, ',')
+		}
+		batch = append(batch, data...)
+	}
+	batches = append(batches, append(batch, ']'))
+
+	lock := r.locks[wal]
+	lock.Lock()
+	defer lock.Unlock()
+	for _, data := range batches {
+		if _, err := wal.Append(context.Background(), data); err != nil {
+			return fmt.Errorf("failed to append events with tag %s: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) route(tag string) s3_log.WAL {
+	for _, route := range r.routes {
+		if MatchTag(route.Pattern, tag) {
+			return route.WAL
+		}
+	}
+	return nil
+}
+
+// MatchTag reports whether tag matches the Fluentd style pattern.
+func MatchTag(pattern, tag string) bool {
+	return matchParts(strings.Split(pattern, "."), strings.Split(tag, "."))
+}
+
+func matchParts(pattern, tag []string) bool {
+	if len(pattern) == 0 {
+		return len(tag) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(tag); i++ {
+			if matchParts(pattern[1:], tag[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(tag) == 0 || (pattern[0] != "*" && pattern[0] != tag[0]) {
+		return false
+	}
+	return matchParts(pattern[1:], tag[1:])
+}
+
+// decodeMessage handles the Message, Forward, PackedForward and
+// CompressedPackedForward modes
+func decodeMessage(msg []any) (string, []Event, map[string]any, error) {
+	if len(msg) < 2 {
+		return "", nil, nil, fmt.Errorf("invalid message of %d elements", len(msg))
+	}
+	tag, ok := msg[0].(string)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("invalid tag of type %T", msg[0])
+	}
+
+	var option map[string]any
+	optionAt := 2
+	switch msg[1].(type) {
+	case []any, string, []byte:
+	default:
+		// Message mode: [tag, time, record, option]
+		optionAt = 3
+	}
+	if len(msg) > optionAt {
+		if option, ok = msg[optionAt].(map[string]any); !ok && msg[optionAt] != nil {
+			return "", nil, nil, fmt.Errorf("invalid option of type %T", msg[optionAt])
+		}
+	}
+
+	switch entries := msg[1].(type) {
+	case []any:
+		var events []Event
+		for _, entry := range entries {
+			pair, ok := entry.([]any)
+			if !ok || len(pair) != 2 {
+				return "", nil, nil, fmt.Errorf("invalid entry in forward mode")
+			}
+			e, err := newEvent(tag, pair[0], pair[1])
+			if err != nil {
+				return "", nil, nil, err
+			}
+			events = append(events, e)
+		}
+		return tag, events, option, nil
+	case string:
+		events, err := decodePacked(tag, []byte(entries), option)
+		return tag, events, option, err
+	case []byte:
+		events, err := decodePacked(tag, entries, option)
+		return tag, events, option, err
+	}
+
+	if len(msg) < 3 {
+		return "", nil, nil, fmt.Errorf("invalid message mode event")
+	}
+	e, err := newEvent(tag, msg[1], msg[2])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return tag, []Event{e}, option, nil
+}
+
+func decodePacked(tag string, packed []byte, option map[string]any) ([]Event, error) {
+	var r io.Reader = bytes.NewReader(packed)
+	if option["compressed"] == "gzip" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress entries: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	dec := msgpack.NewDecoder(&limitedReader{r: bufio.NewReader(r), n: maxDecompressedSize})
+	var events []Event
+	for {
+		var pair []any
+		err := dec.Decode(&pair)
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if errors.Is(err, errTooLarge) {
+			return nil, fmt.Errorf("decompressed entries are over the limit of %d bytes", maxDecompressedSize)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode packed entry: %w", err)
+		}
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid packed entry of %d elements", len(pair))
+		}
+		e, err := newEvent(tag, pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+}
+
+// limitedReader fails with errTooLarge once n bytes are read. It implements
+// io.ByteScanner so that the msgpack decoder reads from it directly, instead
+// of through a buffer that would count bytes of the next message.
+type limitedReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (l *limitedReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, errTooLarge
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.n--
+	}
+	return b, err
+}
+
+func (l *limitedReader) UnreadByte() error {
+	err := l.r.UnreadByte()
+	if err == nil {
+		l.n++
+	}
+	return err
+}
+
+func newEvent(tag string, t any, record any) (Event, error) {
+	e := Event{Tag: tag}
+	switch t := t.(type) {
+	case *EventTime:
+		e.Time = t.Time
+	case EventTime:
+		e.Time = t.Time
+	case time.Time:
+		e.Time = t.UTC()
+	default:
+		sec, ok := toInt64(t)
+		if !ok {
+			return Event{}, fmt.Errorf("invalid event time of type %T", t)
+		}
+		e.Time = time.Unix(sec, 0).UTC()
+	}
+	m, ok := record.(map[string]any)
+	if !ok {
+		return Event{}, fmt.Errorf("invalid event record of type %T", record)
+	}
+	e.Record = m
+	return e, nil
+}
+
+// toInt64 converts the integer types msgpack decodes into, which depend on
+// the size of the encoded value
+func toInt64(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// DecodeEvents decodes a record written by Receiver.
+func DecodeEvents(record s3_log.Record) ([]Event, error) {
+	var events []Event
+	err := json.Unmarshal(record.Data, &events)
+	return events, err
+}
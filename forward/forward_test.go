@@ -0,0 +1,205 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func TestMatchTag(t *testing.T) {
+	tests := []struct {
+		pattern, tag string
+		match        bool
+	}{
+		{"app.*", "app.web", true},
+		{"app.*", "app.web.access", false},
+		{"app.**", "app.web.access", true},
+		{"app.**", "app", true},
+		{"**", "anything.at.all", true},
+		{"a.b", "a.c", false},
+	}
+	for _, tt := range tests {
+		if got := MatchTag(tt.pattern, tt.tag); got != tt.match {
+			t.Errorf("MatchTag(%q, %q) = %v, expected %v", tt.pattern, tt.tag, got, tt.match)
+		}
+	}
+}
+
+func startReceiver(t *testing.T, routes []Route) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewReceiver(routes, nil).Serve(l)
+	t.Cleanup(func() { l.Close() })
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readAck(t *testing.T, conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var resp map[string]string
+	err := msgpack.NewDecoder(conn).Decode(&resp)
+	return resp["ack"], err
+}
+
+func TestReceiverModes(t *testing.T) {
+	app, other := &waltest.MemWAL{}, &waltest.MemWAL{}
+	conn := startReceiver(t, []Route{
+		{Pattern: "app.**", WAL: app},
+		{Pattern: "other", WAL: other},
+	})
+	enc := msgpack.NewEncoder(conn)
+	ts := &EventTime{time.Unix(1700000000, 123456789).UTC()}
+
+	// Message mode
+	if err := enc.Encode([]any{"app.web", ts, map[string]any{"msg": "hello"}, map[string]any{"chunk": "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err != nil || ack != "c1" {
+		t.Fatalf("expected ack c1, got %q, %v", ack, err)
+	}
+
+	// Forward mode
+	entries := []any{
+		[]any{ts, map[string]any{"n": 1}},
+		[]any{int64(1700000001), map[string]any{"n": 2}},
+	}
+	if err := enc.Encode([]any{"app.db", entries, map[string]any{"chunk": "c2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err != nil || ack != "c2" {
+		t.Fatalf("expected ack c2, got %q, %v", ack, err)
+	}
+
+	// CompressedPackedForward mode
+	var packed bytes.Buffer
+	gz := gzip.NewWriter(&packed)
+	penc := msgpack.NewEncoder(gz)
+	penc.Encode([]any{ts, map[string]any{"n": 3}})
+	penc.Encode([]any{ts, map[string]any{"n": 4}})
+	gz.Close()
+	if err := enc.Encode([]any{"other", packed.Bytes(), map[string]any{"chunk": "c3", "compressed": "gzip"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err != nil || ack != "c3" {
+		t.Fatalf("expected ack c3, got %q, %v", ack, err)
+	}
+
+	// one record per message
+	if app.Len() != 2 || other.Len() != 1 {
+		t.Fatalf("expected 2 and 1 records, got %d and %d", app.Len(), other.Len())
+	}
+	record, _ := app.Read(context.Background(), 1)
+	events, err := DecodeEvents(record)
+	if err != nil {
+		t.Fatalf("failed to decode events: %v", err)
+	}
+	if e := events[0]; len(events) != 1 || e.Tag != "app.web" || !e.Time.Equal(ts.Time) || e.Record["msg"] != "hello" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	record, _ = app.Read(context.Background(), 2)
+	if events, _ = DecodeEvents(record); len(events) != 2 || events[1].Time.Unix() != 1700000001 {
+		t.Errorf("expected both events with the integer timestamp kept, got %+v", events)
+	}
+	record, _ = other.Read(context.Background(), 1)
+	if events, _ = DecodeEvents(record); len(events) != 2 || events[1].Record["n"] != float64(4) {
+		t.Errorf("expected both packed events, got %+v", events)
+	}
+}
+
+func TestReceiverSplitsLargeMessages(t *testing.T) {
+	app := &waltest.MemWAL{}
+	conn := startReceiver(t, []Route{{Pattern: "app", WAL: app}})
+	line := strings.Repeat("x", maxBatchSize/4)
+	var entries []any
+	for i := range 10 {
+		entries = append(entries, []any{int64(1700000000), map[string]any{"n": i, "line": line}})
+	}
+	if err := msgpack.NewEncoder(conn).Encode([]any{"app", entries, map[string]any{"chunk": "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err != nil || ack != "c1" {
+		t.Fatalf("expected ack c1, got %q, %v", ack, err)
+	}
+
+	var n int
+	for offset := uint64(1); offset <= uint64(app.Len()); offset++ {
+		record, _ := app.Read(context.Background(), offset)
+		if len(record.Data) > maxBatchSize {
+			t.Errorf("record at %d is %d bytes, over the limit", offset, len(record.Data))
+		}
+		events, err := DecodeEvents(record)
+		if err != nil {
+			t.Fatalf("failed to decode events: %v", err)
+		}
+		for _, e := range events {
+			if e.Record["n"] != float64(n) {
+				t.Fatalf("expected event %d, got %v", n, e.Record["n"])
+			}
+			n++
+		}
+	}
+	if app.Len() < 2 || n != 10 {
+		t.Errorf("expected 10 events over several records, got %d in %d", n, app.Len())
+	}
+}
+
+func TestReceiverNoAckOnFailure(t *testing.T) {
+	app := &waltest.MemWAL{}
+	app.FailAppends(errors.New("S3 is down"))
+	conn := startReceiver(t, []Route{{Pattern: "app", WAL: app}})
+	err := msgpack.NewEncoder(conn).Encode([]any{"app", int64(1700000000), map[string]any{"msg": "lost"}, map[string]any{"chunk": "c1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err == nil {
+		t.Errorf("expected connection to close without ack, got ack %q", ack)
+	}
+}
+
+func TestReceiverRejectsOversizedMessages(t *testing.T) {
+	app := &waltest.MemWAL{}
+	conn := startReceiver(t, []Route{{Pattern: "app", WAL: app}})
+	line := strings.Repeat("x", maxMessageSize)
+	err := msgpack.NewEncoder(conn).Encode([]any{"app", int64(1700000000), map[string]any{"line": line}, map[string]any{"chunk": "c1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err == nil {
+		t.Errorf("expected connection to close without ack, got ack %q", ack)
+	}
+
+	// a small message that decompresses to more than the limit
+	conn = startReceiver(t, []Route{{Pattern: "app", WAL: app}})
+	var packed bytes.Buffer
+	gz := gzip.NewWriter(&packed)
+	line = strings.Repeat("x", maxDecompressedSize)
+	if err := msgpack.NewEncoder(gz).Encode([]any{int64(1700000000), map[string]any{"line": line}}); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	err = msgpack.NewEncoder(conn).Encode([]any{"app", packed.Bytes(), map[string]any{"chunk": "c2", "compressed": "gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := readAck(t, conn); err == nil {
+		t.Errorf("expected connection to close without ack, got ack %q", ack)
+	}
+	if app.Len() != 0 {
+		t.Errorf("expected nothing appended, got %d records", app.Len())
+	}
+}
@@ -0,0 +1,96 @@
+// Package s3test sets up buckets on the local MinIO that the integration
+// tests of the subpackages run against.
+package s3test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RandomStr returns a random string that is safe to use in bucket names and
+// prefixes.
+func RandomStr() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Client returns a client for the MinIO at 127.0.0.1:9000.
+func Client() *s3.Client {
+	// https://stackoverflow.com/a/78815403
+	// thank you lurenyang
+	return s3.NewFromConfig(aws.Config{Region: "us-east-1"}, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String("http://127.0.0.1:9000")
+		o.Credentials = credentials.NewStaticCredentialsProvider("minioadmin", "minioadmin", "")
+	})
+}
+
+// Bucket creates a bucket with a random name and deletes it along with
+// everything in it, old versions included, when the test ends.
+func Bucket(t testing.TB, client *s3.Client) string {
+	t.Helper()
+	bucketName := "test-wal-bucket-" + RandomStr()
+	_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		if err := emptyBucket(ctx, client, bucketName); err != nil {
+			t.Logf("failed to empty bucket during cleanup: %v", err)
+		}
+		_, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{
+			Bucket: aws.String(bucketName),
+		})
+		if err != nil {
+			t.Logf("failed to delete bucket during cleanup: %v", err)
+		}
+	})
+	return bucketName
+}
+
+// emptyBucket deletes every version of every object because dumbass AWS does
+// not have a direct API
+func emptyBucket(ctx context.Context, client *s3.Client, bucketName string) error {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketName),
+	}
+	paginator := s3.NewListObjectVersionsPaginator(client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list object versions: %w", err)
+		}
+		var objectIds []types.ObjectIdentifier
+		for _, v := range output.Versions {
+			objectIds = append(objectIds, types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range output.DeleteMarkers {
+			objectIds = append(objectIds, types.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+		if len(objectIds) == 0 {
+			continue
+		}
+		_, err = client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &types.Delete{
+				Objects: objectIds,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+	}
+	return nil
+}
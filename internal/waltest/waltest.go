@@ -0,0 +1,89 @@
+// Package waltest provides an in-memory WAL for tests of the packages built
+// on top of s3_log.WAL.
+package waltest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// MemWAL is a WAL that keeps its records in memory. It is safe for
+// concurrent use.
+type MemWAL struct {
+	mu        sync.Mutex
+	records   [][]byte
+	reads     int
+	appendErr error
+	failRead  uint64
+}
+
+func (m *MemWAL) Append(ctx context.Context, data []byte) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.appendErr != nil {
+		return 0, m.appendErr
+	}
+	m.records = append(m.records, data)
+	return uint64(len(m.records)), nil
+}
+
+func (m *MemWAL) Read(ctx context.Context, offset uint64) (s3_log.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.read(offset)
+}
+
+func (m *MemWAL) read(offset uint64) (s3_log.Record, error) {
+	if offset == 0 || offset > uint64(len(m.records)) || offset == m.failRead {
+		return s3_log.Record{}, fmt.Errorf("offset %d not found", offset)
+	}
+	m.reads++
+	return s3_log.Record{Offset: offset, Data: m.records[offset-1]}, nil
+}
+
+func (m *MemWAL) LastRecord(ctx context.Context) (s3_log.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.records) == 0 {
+		return s3_log.Record{}, s3_log.ErrEmpty
+	}
+	return m.read(uint64(len(m.records)))
+}
+
+// Len returns the number of records in the log.
+func (m *MemWAL) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.records)
+}
+
+// Reads returns the number of records read so far, including by LastRecord.
+func (m *MemWAL) Reads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reads
+}
+
+// Set replaces the record at offset behind the log's back.
+func (m *MemWAL) Set(offset uint64, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[offset-1] = data
+}
+
+// FailAppends makes every append fail with err until it is called with nil.
+func (m *MemWAL) FailAppends(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appendErr = err
+}
+
+// FailRead makes reads of offset fail as if it did not exist, 0 for none.
+func (m *MemWAL) FailRead(offset uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failRead = offset
+}
@@ -0,0 +1,204 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var ErrLeaseLost = errors.New("lease is held by another owner")
+
+type leaseState struct {
+	Owner     string    `json:"owner"`
+	Epoch     uint64    `json:"epoch"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Lease elects a single owner for a log, so that only one server appends to
+// it while the others forward their appends to the owner, as server.Log
+// does. The lease is an object next to the log, updated with conditional
+// puts on its ETag. Expiry is judged by the local clock, so ttl should be
+// well above the clock skew between servers.
+//
+// The conditional put in Append only fails for an old owner once the new one
+// has written the same offset, so an old owner that has not noticed it lost
+// the lease could otherwise keep appending until then. Pass the lease to
+// S3WAL.UseLease to refuse appends once it has expired by the local clock,
+// which happens before another owner can take it over. A new owner must call
+// LastRecord on its S3WAL before appending, which keeps offsets continuous
+// across failovers. An append that was already in flight when the lease
+// expired may still land, and the new owner then sees it as the tail.
+type Lease struct {
+	client     *s3.Client
+	bucketName string
+	key        string
+	owner      string
+	ttl        time.Duration
+	mu         sync.Mutex
+	etag       string
+	state      leaseState
+}
+
+func NewLease(client *s3.Client, bucketName, prefix, owner string, ttl time.Duration) *Lease {
+	return &Lease{
+		client:     client,
+		bucketName: bucketName,
+		// outside of `prefix/`, so that listing the log does not see it
+		key:   prefix + ".lease",
+		owner: owner,
+		ttl:   ttl,
+	}
+}
+
+func (l *Lease) get(ctx context.Context) (leaseState, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(l.bucketName),
+		Key:    aws.String(l.key),
+	}
+	result, err := l.client.GetObject(ctx, input)
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return leaseState{}, "", nil
+		}
+		return leaseState{}, "", fmt.Errorf("failed to get lease from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return leaseState{}, "", fmt.Errorf("failed to read lease body: %w", err)
+	}
+	var state leaseState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return leaseState{}, "", fmt.Errorf("failed to decode lease: %w", err)
+	}
+	return state, aws.ToString(result.ETag), nil
+}
+
+// put replaces the lease object if it still has the given ETag, or creates
+// it if etag is empty
+func (l *Lease) put(ctx context.Context, state leaseState, etag string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode lease: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(l.bucketName),
+		Key:    aws.String(l.key),
+		Body:   bytes.NewReader(data),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	result, err := l.client.PutObject(ctx, input)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return ErrLeaseLost
+		}
+		return fmt.Errorf("failed to put lease to S3: %w", err)
+	}
+	l.mu.Lock()
+	l.etag = aws.ToString(result.ETag)
+	l.state = state
+	l.mu.Unlock()
+	return nil
+}
+
+// current returns the ETag and state of the lease as we last wrote it
+func (l *Lease) current() (string, leaseState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.etag, l.state
+}
+
+// Acquire takes the lease if it is free, expired or already ours. It returns
+// ErrLeaseLost if another owner holds it.
+func (l *Lease) Acquire(ctx context.Context) error {
+	state, etag, err := l.get(ctx)
+	if err != nil {
+		return err
+	}
+	if etag != "" && state.Owner != l.owner && time.Now().Before(state.ExpiresAt) {
+		return ErrLeaseLost
+	}
+	epoch := state.Epoch
+	if state.Owner != l.owner || etag == "" {
+		epoch++
+	}
+	return l.put(ctx, leaseState{
+		Owner:     l.owner,
+		Epoch:     epoch,
+		ExpiresAt: time.Now().Add(l.ttl),
+	}, etag)
+}
+
+// Renew extends a lease we hold. It returns ErrLeaseLost if someone else took
+// it over in the meantime, in which case we must stop appending.
+func (l *Lease) Renew(ctx context.Context) error {
+	etag, state := l.current()
+	if etag == "" {
+		return ErrLeaseLost
+	}
+	state.ExpiresAt = time.Now().Add(l.ttl)
+	return l.put(ctx, state, etag)
+}
+
+// Release gives up a lease we hold by expiring it immediately.
+func (l *Lease) Release(ctx context.Context) error {
+	etag, state := l.current()
+	if etag == "" {
+		return nil
+	}
+	state.ExpiresAt = time.Time{}
+	err := l.put(ctx, state, etag)
+	l.mu.Lock()
+	l.etag = ""
+	l.mu.Unlock()
+	return err
+}
+
+// Leader returns the current owner of the lease and its epoch, or an empty
+// owner if the lease is free or expired. Followers use it to find out where
+// to forward appends.
+func (l *Lease) Leader(ctx context.Context) (string, uint64, error) {
+	state, etag, err := l.get(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	if etag == "" || !time.Now().Before(state.ExpiresAt) {
+		return "", state.Epoch, nil
+	}
+	return state.Owner, state.Epoch, nil
+}
+
+// Owner returns the owner this lease is acquired as.
+func (l *Lease) Owner() string {
+	return l.owner
+}
+
+// Epoch returns the epoch of the lease we hold. It increases every time the
+// lease changes owner.
+func (l *Lease) Epoch() uint64 {
+	_, state := l.current()
+	return state.Epoch
+}
+
+// Held reports whether we hold the lease and it has not expired yet by the
+// local clock. The expiry was set before the last renewal was sent, so it is
+// never later than the one other servers see.
+func (l *Lease) Held() bool {
+	etag, state := l.current()
+	return etag != "" && time.Now().Before(state.ExpiresAt)
+}
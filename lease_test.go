@@ -0,0 +1,71 @@
+package s3_log
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseFailover(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	first := NewLease(wal.client, wal.bucketName, wal.prefix, "node-1", 200*time.Millisecond)
+	second := NewLease(wal.client, wal.bucketName, wal.prefix, "node-2", 200*time.Millisecond)
+
+	wal.UseLease(first)
+	if _, err := wal.Append(ctx, []byte("before the lease")); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost before acquiring the lease, got %v", err)
+	}
+	if err := first.Acquire(ctx); err != nil {
+		t.Fatalf("failed to acquire lease: %v", err)
+	}
+	if err := second.Acquire(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost while lease is held, got %v", err)
+	}
+	leader, _, err := second.Leader(ctx)
+	if err != nil {
+		t.Fatalf("failed to get leader: %v", err)
+	}
+	if leader != "node-1" {
+		t.Errorf("expected leader node-1, got %q", leader)
+	}
+	if _, err = wal.Append(ctx, []byte("from node-1")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	// the old leader stops appending as soon as its lease expires, before the
+	// new leader has written anything
+	if _, err = wal.Append(ctx, []byte("from expired node-1")); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost from an expired leader, got %v", err)
+	}
+	if err = second.Acquire(ctx); err != nil {
+		t.Fatalf("failed to acquire expired lease: %v", err)
+	}
+	if second.Epoch() <= first.Epoch() {
+		t.Errorf("expected epoch to increase on failover, got %d after %d", second.Epoch(), first.Epoch())
+	}
+	if err = first.Renew(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost when renewing a lost lease, got %v", err)
+	}
+
+	// the new leader picks up where the old one stopped
+	newWAL := NewS3WAL(wal.client, wal.bucketName, wal.prefix)
+	newWAL.UseLease(second)
+	if _, err = newWAL.LastRecord(ctx); err != nil {
+		t.Fatalf("failed to get last record: %v", err)
+	}
+	offset, err := newWAL.Append(ctx, []byte("from node-2"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if offset != 2 {
+		t.Errorf("expected offset 2 after failover, got %d", offset)
+	}
+	if _, err = wal.Append(ctx, []byte("from stale node-1")); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost from a stale leader, got %v", err)
+	}
+}
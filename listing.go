@@ -0,0 +1,287 @@
+package s3_log
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultScanParallelism is how many ranges are listed at once when the
+// caller does not say
+const defaultScanParallelism = 8
+
+// ScanRange is a range of offsets [From, To] of a scan, To being 0 for no
+// upper bound. Next is the first offset that was not listed yet.
+type ScanRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+	Next uint64 `json:"next"`
+	Done bool   `json:"done"`
+}
+
+// ScanCheckpoint is the progress of a scan. It marshals to JSON, so that it
+// can be stored and the scan resumed from it after an interruption.
+type ScanCheckpoint struct {
+	Ranges []ScanRange `json:"ranges"`
+}
+
+// Done reports whether every range has been listed.
+func (c *ScanCheckpoint) Done() bool {
+	for _, r := range c.Ranges {
+		if !r.Done {
+			return false
+		}
+	}
+	return true
+}
+
+type ScanOptions struct {
+	// Parallelism is how many ranges are listed at once
+	Parallelism int
+	// Checkpoint, if set, is called with the progress after every page,
+	// never concurrently and always after the page was handed to the caller
+	Checkpoint func(ScanCheckpoint) error
+}
+
+// PlanScan splits the log into parts disjoint ranges of about the same size.
+// Keys are the zero padded offsets, so they sort like the offsets and each
+// range can be listed on its own with StartAfter. The last range has no upper
+// bound, to also cover records appended during the scan.
+func (w *S3WAL) PlanScan(ctx context.Context, parts int) (ScanCheckpoint, error) {
+	last, err := w.lastOffset(ctx)
+	if err != nil {
+		return ScanCheckpoint{}, err
+	}
+	parts = max(1, min(parts, int(min(last, math.MaxInt))))
+	size := max(last/uint64(parts), 1)
+	var cp ScanCheckpoint
+	for i := 0; i < parts; i++ {
+		r := ScanRange{From: uint64(i)*size + 1, To: uint64(i+1) * size}
+		if i == parts-1 {
+			r.To = 0
+		}
+		r.Next = r.From
+		cp.Ranges = append(cp.Ranges, r)
+	}
+	return cp, nil
+}
+
+// scan runs page on every unfinished range of cp in parallel until they are
+// all done. page lists from r.Next, hands what it found to the caller and
+// advances r; it runs with mu held, so that the caller and the checkpoint
+// always agree.
+func (w *S3WAL) scan(ctx context.Context, cp *ScanCheckpoint, opts ScanOptions, page func(ctx context.Context, r *ScanRange, mu *sync.Mutex) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultScanParallelism
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	sem := make(chan struct{}, parallelism)
+	for i := range cp.Ranges {
+		if cp.Ranges[i].Done {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *ScanRange) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := func() error {
+				for {
+					mu.Lock()
+					done := r.Done
+					mu.Unlock()
+					if done {
+						return nil
+					}
+					if err := page(ctx, r, &mu); err != nil {
+						return err
+					}
+					if opts.Checkpoint != nil {
+						mu.Lock()
+						err := opts.Checkpoint(*cp)
+						mu.Unlock()
+						if err != nil {
+							return fmt.Errorf("failed to save checkpoint: %w", err)
+						}
+					}
+				}
+			}()
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(&cp.Ranges[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// inRange reports whether offset is below the end of r
+func (r *ScanRange) inRange(offset uint64) bool {
+	return r.To == 0 || offset <= r.To
+}
+
+// ScanObjects lists the objects of the log in the ranges of cp in parallel,
+// calling fn with each page of objects in a range, in key order within the
+// range. fn is never called concurrently. cp is updated as the scan goes, so
+// that calling ScanObjects again with it after an error resumes the scan.
+func (w *S3WAL) ScanObjects(ctx context.Context, cp *ScanCheckpoint, opts ScanOptions, fn func(objects []types.Object) error) error {
+	return w.scan(ctx, cp, opts, func(ctx context.Context, r *ScanRange, mu *sync.Mutex) error {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(w.bucketName),
+			Prefix: aws.String(w.prefix + "/"),
+		}
+		if r.Next > 1 {
+			input.StartAfter = aws.String(w.getObjectKey(r.Next - 1))
+		}
+		output, err := w.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to list objects from S3: %w", err)
+		}
+		objects := output.Contents
+		next, done := r.Next, !aws.ToBool(output.IsTruncated)
+		for i, obj := range objects {
+			offset, err := w.getOffsetFromKey(aws.ToString(obj.Key))
+			if err != nil {
+				return fmt.Errorf("failed to parse offset from key: %w", err)
+			}
+			if !r.inRange(offset) {
+				objects, done = objects[:i], true
+				break
+			}
+			next = offset + 1
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(objects) > 0 {
+			if err := fn(objects); err != nil {
+				return err
+			}
+		}
+		r.Next, r.Done = next, done
+		return nil
+	})
+}
+
+// ScanVersions is ScanObjects for every version and delete marker of the
+// objects. A page only ever holds whole objects, with all their versions.
+func (w *S3WAL) ScanVersions(ctx context.Context, cp *ScanCheckpoint, opts ScanOptions, fn func(versions []types.ObjectVersion, markers []types.DeleteMarkerEntry) error) error {
+	return w.scan(ctx, cp, opts, func(ctx context.Context, r *ScanRange, mu *sync.Mutex) error {
+		input := &s3.ListObjectVersionsInput{
+			Bucket: aws.String(w.bucketName),
+			Prefix: aws.String(w.prefix + "/"),
+		}
+		if r.Next > 1 {
+			input.KeyMarker = aws.String(w.getObjectKey(r.Next - 1))
+		}
+		var versions []types.ObjectVersion
+		var markers []types.DeleteMarkerEntry
+		done := false
+		for {
+			output, err := w.client.ListObjectVersions(ctx, input)
+			if err != nil {
+				return fmt.Errorf("failed to list object versions from S3: %w", err)
+			}
+			versions = append(versions, output.Versions...)
+			markers = append(markers, output.DeleteMarkers...)
+			if !aws.ToBool(output.IsTruncated) {
+				done = true
+				break
+			}
+			if len(output.Versions)+len(output.DeleteMarkers) == 0 {
+				break
+			}
+			// the versions of the last key may go on in the next page, so
+			// it is left for the next round, unless it is all there is
+			last := aws.ToString(output.NextKeyMarker)
+			isLast := func(key *string) bool { return aws.ToString(key) == last }
+			other := slices.ContainsFunc(versions, func(v types.ObjectVersion) bool { return !isLast(v.Key) }) ||
+				slices.ContainsFunc(markers, func(m types.DeleteMarkerEntry) bool { return !isLast(m.Key) })
+			if other {
+				versions = slices.DeleteFunc(versions, func(v types.ObjectVersion) bool { return isLast(v.Key) })
+				markers = slices.DeleteFunc(markers, func(m types.DeleteMarkerEntry) bool { return isLast(m.Key) })
+				break
+			}
+			input.KeyMarker = output.NextKeyMarker
+			input.VersionIdMarker = output.NextVersionIdMarker
+		}
+
+		next := r.Next
+		inRange := func(key *string) (bool, error) {
+			offset, err := w.getOffsetFromKey(aws.ToString(key))
+			if err != nil {
+				return false, fmt.Errorf("failed to parse offset from key: %w", err)
+			}
+			if !r.inRange(offset) {
+				done = true
+				return false, nil
+			}
+			next = max(next, offset+1)
+			return true, nil
+		}
+		var err error
+		versions = slices.DeleteFunc(versions, func(v types.ObjectVersion) bool {
+			ok, perr := inRange(v.Key)
+			err = cmp.Or(err, perr)
+			return !ok
+		})
+		markers = slices.DeleteFunc(markers, func(m types.DeleteMarkerEntry) bool {
+			ok, perr := inRange(m.Key)
+			err = cmp.Or(err, perr)
+			return !ok
+		})
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(versions)+len(markers) > 0 {
+			if err := fn(versions, markers); err != nil {
+				return err
+			}
+		}
+		r.Next, r.Done = next, done
+		return nil
+	})
+}
+
+// hasAfter reports whether the log has an object after offset, listing a
+// single key
+func (w *S3WAL) hasAfter(ctx context.Context, offset uint64) (bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:     aws.String(w.bucketName),
+		Prefix:     aws.String(w.prefix + "/"),
+		StartAfter: aws.String(w.getObjectKey(offset)),
+		MaxKeys:    aws.Int32(1),
+	}
+	output, err := w.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("failed to list objects from S3: %w", err)
+	}
+	if len(output.Contents) == 0 {
+		return false, nil
+	}
+	if _, err = w.getOffsetFromKey(aws.ToString(output.Contents[0].Key)); err != nil {
+		return false, fmt.Errorf("failed to parse offset from key: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestLastOffsetSearch(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, offset := range []uint64{1, 2, 5, 1000, 1023, 1024, 1025} {
+		body, err := prepareBody(offset, []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wal.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(wal.bucketName),
+			Key:    aws.String(wal.getObjectKey(offset)),
+			Body:   bytes.NewReader(body),
+		})
+		if err != nil {
+			t.Fatalf("failed to put object: %v", err)
+		}
+		last, err := wal.lastOffset(ctx)
+		if err != nil {
+			t.Fatalf("failed to find last offset: %v", err)
+		}
+		if last != offset {
+			t.Errorf("expected last offset %d, got %d", offset, last)
+		}
+	}
+}
+
+func TestScanObjects(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for i := 0; i < 25; i++ {
+		if _, err := wal.Append(ctx, []byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	cp, err := wal.PlanScan(ctx, 4)
+	if err != nil {
+		t.Fatalf("failed to plan scan: %v", err)
+	}
+	if len(cp.Ranges) != 4 || cp.Ranges[0].From != 1 || cp.Ranges[3].To != 0 {
+		t.Fatalf("unexpected ranges %+v", cp.Ranges)
+	}
+	// appended after planning, the last range still covers it
+	if _, err = wal.Append(ctx, []byte("late")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	// offsets are only taken as seen once the checkpoint covering them is
+	// saved, like a caller that stores both together would
+	var seen, pending []uint64
+	var saved []byte
+	collect := func(objects []types.Object) error {
+		for _, obj := range objects {
+			offset, err := wal.getOffsetFromKey(*obj.Key)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, offset)
+		}
+		return nil
+	}
+	interrupted := errors.New("interrupted")
+	saves := 0
+	opts := ScanOptions{
+		Parallelism: 2,
+		Checkpoint: func(cp ScanCheckpoint) error {
+			if saves == 2 {
+				return interrupted
+			}
+			saves++
+			seen, pending = append(seen, pending...), nil
+			var merr error
+			saved, merr = json.Marshal(cp)
+			return merr
+		},
+	}
+	if err = wal.ScanObjects(ctx, &cp, opts, collect); !errors.Is(err, interrupted) {
+		t.Fatalf("expected the scan to be interrupted, got %v", err)
+	}
+
+	var resumed ScanCheckpoint
+	if err = json.Unmarshal(saved, &resumed); err != nil {
+		t.Fatalf("failed to decode checkpoint: %v", err)
+	}
+	if resumed.Done() {
+		t.Fatal("expected the saved checkpoint to have work left")
+	}
+	pending = nil
+	opts.Checkpoint = func(cp ScanCheckpoint) error {
+		seen, pending = append(seen, pending...), nil
+		return nil
+	}
+	if err = wal.ScanObjects(ctx, &resumed, opts, collect); err != nil {
+		t.Fatalf("failed to resume scan: %v", err)
+	}
+	if !resumed.Done() {
+		t.Error("expected the scan to be done")
+	}
+	slices.Sort(seen)
+	for i, offset := range seen {
+		if offset != uint64(i+1) {
+			t.Fatalf("expected every offset from 1 to 26 once, got %v", seen)
+		}
+	}
+	if len(seen) != 26 {
+		t.Errorf("expected 26 offsets, got %d", len(seen))
+	}
+}
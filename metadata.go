@@ -0,0 +1,76 @@
+package s3_log
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// reservedMetadataPrefix is used for the metadata the WAL itself stores, such
+// as the seal marker
+const reservedMetadataPrefix = "s3log-"
+
+// RecordInfo describes the S3 object a record is stored in.
+type RecordInfo struct {
+	ETag         string
+	LastModified time.Time
+	// Size is the size of the object, including the offset and checksum
+	Size      int64
+	VersionID string
+	// Metadata is the x-amz-meta-* headers of the object, with lower case keys
+	Metadata map[string]string
+}
+
+func validateMetadata(metadata map[string]string) error {
+	for k := range metadata {
+		if strings.HasPrefix(strings.ToLower(k), reservedMetadataPrefix) {
+			return fmt.Errorf("metadata key %q uses the reserved prefix %q", k, reservedMetadataPrefix)
+		}
+	}
+	return nil
+}
+
+// userMetadata returns metadata without the keys the WAL reserves for itself
+func userMetadata(metadata map[string]string) map[string]string {
+	user := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if !strings.HasPrefix(strings.ToLower(k), reservedMetadataPrefix) {
+			user[k] = v
+		}
+	}
+	return user
+}
+
+// HeadRecord returns the details of the record object at offset without
+// fetching its body, which makes it cheap to filter on metadata.
+func (w *S3WAL) HeadRecord(ctx context.Context, offset uint64) (RecordInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(w.bucketName),
+		Key:    aws.String(w.getObjectKey(offset)),
+	}
+	if w.versioned {
+		version, err := w.originalVersion(ctx, offset)
+		if err != nil {
+			return RecordInfo{}, err
+		}
+		input.VersionId = aws.String(version)
+	}
+	result, err := w.client.HeadObject(ctx, input)
+	if err != nil {
+		return RecordInfo{}, fmt.Errorf("failed to head object from S3: %w", err)
+	}
+	if isSealMarker(result.Metadata) {
+		return RecordInfo{}, ErrSealed
+	}
+	return RecordInfo{
+		ETag:         aws.ToString(result.ETag),
+		LastModified: aws.ToTime(result.LastModified),
+		Size:         aws.ToInt64(result.ContentLength),
+		VersionID:    aws.ToString(result.VersionId),
+		Metadata:     result.Metadata,
+	}, nil
+}
@@ -0,0 +1,70 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecordMetadata(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	offset, err := wal.AppendWithMetadata(ctx, []byte("hello"), map[string]string{"Content-Kind": "greeting"})
+	if err != nil {
+		t.Fatalf("failed to append with metadata: %v", err)
+	}
+	if _, err = wal.Append(ctx, []byte("plain")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	record, info, err := wal.ReadWithInfo(ctx, offset)
+	if err != nil {
+		t.Fatalf("failed to read with info: %v", err)
+	}
+	if !bytes.Equal(record.Data, []byte("hello")) {
+		t.Errorf("expected data 'hello', got %q", record.Data)
+	}
+	if info.ETag == "" || info.LastModified.IsZero() {
+		t.Errorf("expected ETag and LastModified to be set, got %+v", info)
+	}
+	// offset, payload and checksum
+	if info.Size != int64(8+len("hello")+32) {
+		t.Errorf("expected size %d, got %d", 8+len("hello")+32, info.Size)
+	}
+	if info.Metadata["content-kind"] != "greeting" {
+		t.Errorf("expected metadata content-kind=greeting, got %v", info.Metadata)
+	}
+
+	head, err := wal.HeadRecord(ctx, offset)
+	if err != nil {
+		t.Fatalf("failed to head record: %v", err)
+	}
+	if head.ETag != info.ETag || head.Metadata["content-kind"] != "greeting" {
+		t.Errorf("expected HEAD to match GET, got %+v and %+v", head, info)
+	}
+
+	_, info, err = wal.ReadWithInfo(ctx, offset+1)
+	if err != nil {
+		t.Fatalf("failed to read with info: %v", err)
+	}
+	if len(info.Metadata) != 0 {
+		t.Errorf("expected no metadata, got %v", info.Metadata)
+	}
+
+	if _, err = wal.AppendWithMetadata(ctx, []byte("x"), map[string]string{"S3Log-Sealed": "true"}); err == nil {
+		t.Error("expected reserved metadata key to be rejected")
+	}
+	if wal.length != 2 {
+		t.Errorf("expected rejected append to leave length at 2, got %d", wal.length)
+	}
+
+	if _, err = wal.Seal(ctx, "next"); err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if _, err = wal.HeadRecord(ctx, 3); !errors.Is(err, ErrSealed) {
+		t.Errorf("expected ErrSealed for HEAD of seal marker, got %v", err)
+	}
+}
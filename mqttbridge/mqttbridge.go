@@ -0,0 +1,187 @@
+package mqttbridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// Route sends every publish whose topic matches Filter to WAL. Filter uses the
+// MQTT wildcards + and #.
+type Route struct {
+	Filter string
+	WAL    s3_log.WAL
+}
+
+// Message is how a publish is stored in the log.
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// Hook is a mochi-mqtt hook that appends publishes to logs. The broker calls
+// OnPublish before it acknowledges a publish, so a QoS 1 PUBACK or QoS 2
+// PUBREC, and with it the PUBCOMP, is only sent once the message is durably
+// in S3. If the append fails the publish is dropped without an
+// acknowledgement and the client is disconnected, with reason code 0x89
+// (server busy) under MQTT 5. A client with a persistent session sends the
+// publish again when it reconnects. An MQTT 5 error code in a PUBACK would
+// complete the flow instead, so the client would never resend.
+type Hook struct {
+	mqtt.HookBase
+	routes []Route
+	// WALs are not safe for concurrent appends, and every client publishes
+	// from its own goroutine
+	locks map[s3_log.WAL]*sync.Mutex
+}
+
+func NewHook(routes []Route) *Hook {
+	locks := make(map[s3_log.WAL]*sync.Mutex)
+	for _, r := range routes {
+		if _, ok := locks[r.WAL]; !ok {
+			locks[r.WAL] = &sync.Mutex{}
+		}
+	}
+	return &Hook{routes: routes, locks: locks}
+}
+
+func (h *Hook) ID() string {
+	return "s3log-bridge"
+}
+
+func (h *Hook) Provides(b byte) bool {
+	return b == mqtt.OnPublish
+}
+
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	wal := h.route(pk.TopicName)
+	if wal == nil {
+		return pk, nil
+	}
+	data, err := json.Marshal(Message{
+		Topic:   pk.TopicName,
+		Payload: pk.Payload,
+		QoS:     pk.FixedHeader.Qos,
+		Retain:  pk.FixedHeader.Retain,
+	})
+	if err != nil {
+		return pk, err
+	}
+
+	lock := h.locks[wal]
+	lock.Lock()
+	_, err = wal.Append(context.Background(), data)
+	lock.Unlock()
+	if err != nil {
+		h.Log.Error("failed to append publish", "topic", pk.TopicName, "client", cl.ID, "error", err)
+		if cl.Properties.ProtocolVersion == 5 {
+			cl.WritePacket(packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Disconnect},
+				ReasonCode:  packets.ErrServerBusy.Code,
+				Properties:  packets.Properties{ReasonString: packets.ErrServerBusy.Reason},
+			})
+		}
+		cl.Stop(packets.ErrServerBusy)
+		return pk, packets.ErrRejectPacket
+	}
+	return pk, nil
+}
+
+func (h *Hook) route(topic string) s3_log.WAL {
+	for _, r := range h.routes {
+		if MatchTopic(r.Filter, topic) {
+			return r.WAL
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether topic matches the MQTT topic filter.
+func MatchTopic(filter, topic string) bool {
+	// wildcards do not match topics starting with $, such as $SYS
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	fparts := strings.Split(filter, "/")
+	tparts := strings.Split(topic, "/")
+	for i, f := range fparts {
+		if f == "#" {
+			return i == len(fparts)-1
+		}
+		if i >= len(tparts) {
+			return false
+		}
+		if f != "+" && f != tparts[i] {
+			return false
+		}
+	}
+	return len(fparts) == len(tparts)
+}
+
+// DecodeMessage decodes a record written by Hook.
+func DecodeMessage(record s3_log.Record) (Message, error) {
+	var m Message
+	err := json.Unmarshal(record.Data, &m)
+	return m, err
+}
+
+// AuthHook lets clients connect with one of a fixed set of usernames and
+// passwords, and without a username only if anonymous clients are allowed.
+// Clients that are let in may publish and subscribe to any topic.
+type AuthHook struct {
+	mqtt.HookBase
+	users          map[string]string
+	allowAnonymous bool
+}
+
+// NewAuthHook returns an auth hook for users, which maps usernames to
+// passwords.
+func NewAuthHook(users map[string]string, allowAnonymous bool) *AuthHook {
+	return &AuthHook{users: users, allowAnonymous: allowAnonymous}
+}
+
+func (h *AuthHook) ID() string {
+	return "s3log-auth"
+}
+
+func (h *AuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mqtt.OnConnectAuthenticate, mqtt.OnACLCheck}, []byte{b})
+}
+
+func (h *AuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	if username == "" {
+		return h.allowAnonymous
+	}
+	password, ok := h.users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), pk.Connect.Password) == 1
+}
+
+func (h *AuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return true
+}
+
+// NewServer returns a broker with the bridge hook installed. Listeners and an
+// auth hook, such as AuthHook, still need to be added by the caller, as the
+// broker turns every client away without one.
+func NewServer(routes []Route, logger *slog.Logger) (*mqtt.Server, error) {
+	server := mqtt.New(&mqtt.Options{Logger: logger})
+	if err := server.AddHook(NewHook(routes), nil); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
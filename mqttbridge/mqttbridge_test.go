@@ -0,0 +1,168 @@
+package mqttbridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sensors/+/temp", "sensors/a/temp", true},
+		{"sensors/+/temp", "sensors/a/b/temp", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/a/b", true},
+		{"sensors", "sensors/a", false},
+		{"#", "$SYS/uptime", false},
+		{"a/b", "a/b", true},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("MatchTopic(%q, %q) = %v, expected %v", tt.filter, tt.topic, got, tt.match)
+		}
+	}
+}
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &client{conn: conn, r: bufio.NewReader(conn)}
+	connect := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: "test",
+		},
+	}
+	var buf bytes.Buffer
+	if err = connect.ConnectEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.Write(buf.Bytes())
+	if typ, _ := c.readPacket(t, time.Second); typ != packets.Connack {
+		t.Fatalf("expected CONNACK, got packet type %d", typ)
+	}
+	return c
+}
+
+func (c *client) publish(t *testing.T, topic string, payload []byte, id uint16) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     payload,
+		PacketID:    id,
+	}
+	var buf bytes.Buffer
+	if err := pk.PublishEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.Write(buf.Bytes())
+}
+
+// readPacket returns the type of the next packet, or 0 on timeout
+func (c *client) readPacket(t *testing.T, timeout time.Duration) (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		length += int(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		t.Fatal(err)
+	}
+	return header >> 4, body
+}
+
+func TestBridgeAcksAfterAppend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	sensors, other := &waltest.MemWAL{}, &waltest.MemWAL{}
+	server, err := NewServer([]Route{
+		{Filter: "sensors/#", WAL: sensors},
+		{Filter: "+/other", WAL: other},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddHook(NewAuthHook(nil, true), nil)
+	if err = server.AddListener(listeners.NewTCP(listeners.Config{ID: "t", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := dial(t, addr)
+	c.publish(t, "sensors/kitchen/temp", []byte("21.5"), 1)
+	if typ, _ := c.readPacket(t, time.Second); typ != packets.Puback {
+		t.Fatalf("expected PUBACK, got packet type %d", typ)
+	}
+	record, err := sensors.Read(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("expected publish to be in the log before PUBACK: %v", err)
+	}
+	m, err := DecodeMessage(record)
+	if err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	if m.Topic != "sensors/kitchen/temp" || string(m.Payload) != "21.5" || m.QoS != 1 {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	sensors.FailAppends(errors.New("S3 is down"))
+	c.publish(t, "sensors/kitchen/temp", []byte("22.0"), 2)
+	// the client is disconnected instead, so that it sends the publish again
+	// once it reconnects
+	if typ, _ := c.readPacket(t, time.Second); typ == packets.Puback {
+		t.Error("expected no PUBACK when the append fails")
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the connection to be closed after a failed append, got %v", err)
+	}
+	if other.Len() != 0 {
+		t.Errorf("expected no records in unrelated log, got %d", other.Len())
+	}
+}
@@ -0,0 +1,71 @@
+package multiregion
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp: a physical time in unix
+// nanoseconds and a counter that orders events within the same nanosecond,
+// or while the physical clock lags behind a timestamp seen from another
+// region.
+type Timestamp struct {
+	WallTime int64
+	Logical  uint32
+}
+
+func (t Timestamp) Compare(other Timestamp) int {
+	switch {
+	case t.WallTime < other.WallTime:
+		return -1
+	case t.WallTime > other.WallTime:
+		return 1
+	case t.Logical < other.Logical:
+		return -1
+	case t.Logical > other.Logical:
+		return 1
+	}
+	return 0
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.WallTime, t.Logical)
+}
+
+// Clock is a hybrid logical clock. Every timestamp it returns is greater than
+// the ones it returned before and the ones it was updated with.
+type Clock struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last Timestamp
+}
+
+func NewClock(now func() time.Time) *Clock {
+	if now == nil {
+		now = time.Now
+	}
+	return &Clock{now: now}
+}
+
+// Now returns a timestamp for a local event.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := c.now().UnixNano(); pt > c.last.WallTime {
+		c.last = Timestamp{WallTime: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges a timestamp seen from another region into the clock, so that
+// later local events are ordered after it.
+func (c *Clock) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if remote.Compare(c.last) > 0 {
+		c.last = remote
+	}
+}
@@ -0,0 +1,39 @@
+package multiregion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	now := time.Unix(100, 0)
+	clock := NewClock(func() time.Time { return now })
+
+	a := clock.Now()
+	b := clock.Now()
+	if a != (Timestamp{WallTime: now.UnixNano()}) {
+		t.Errorf("expected physical time with no counter, got %s", a)
+	}
+	if b.Compare(a) <= 0 || b.WallTime != a.WallTime {
+		t.Errorf("expected %s to be after %s in the same nanosecond", b, a)
+	}
+
+	// a timestamp from a region whose clock runs ahead
+	remote := Timestamp{WallTime: now.Add(time.Second).UnixNano(), Logical: 3}
+	clock.Update(remote)
+	if c := clock.Now(); c.Compare(remote) <= 0 {
+		t.Errorf("expected %s to be after remote %s", c, remote)
+	}
+
+	// the physical clock going backwards does not go back in time
+	before := clock.Now()
+	now = now.Add(-time.Minute)
+	if c := clock.Now(); c.Compare(before) <= 0 {
+		t.Errorf("expected %s to be after %s", c, before)
+	}
+
+	now = now.Add(time.Hour)
+	if c := clock.Now(); c != (Timestamp{WallTime: now.UnixNano()}) {
+		t.Errorf("expected clock to follow physical time again, got %s", c)
+	}
+}
@@ -0,0 +1,253 @@
+package multiregion
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+const (
+	kindRecord    = 1
+	kindHeartbeat = 2
+	// kind, wall time, logical
+	headerSize = 1 + 8 + 4
+)
+
+// Region is the sub-log a region appends to. Every region has its own
+// sub-log, usually in a bucket of that region, so appends only ever touch the
+// local one and keep working while the regions cannot reach each other.
+type Region struct {
+	Name string
+	WAL  s3_log.WAL
+}
+
+// Entry is a record of the merged view.
+type Entry struct {
+	Region    string
+	Offset    uint64
+	Timestamp Timestamp
+	Data      []byte
+}
+
+func encode(kind byte, ts Timestamp, data []byte) []byte {
+	buf := make([]byte, headerSize, headerSize+len(data))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], uint64(ts.WallTime))
+	binary.BigEndian.PutUint32(buf[9:13], ts.Logical)
+	return append(buf, data...)
+}
+
+func decode(data []byte) (byte, Timestamp, []byte, error) {
+	if len(data) < headerSize || (data[0] != kindRecord && data[0] != kindHeartbeat) {
+		return 0, Timestamp{}, nil, fmt.Errorf("invalid multi-region record")
+	}
+	ts := Timestamp{
+		WallTime: int64(binary.BigEndian.Uint64(data[1:9])),
+		Logical:  binary.BigEndian.Uint32(data[9:13]),
+	}
+	return data[0], ts, data[headerSize:], nil
+}
+
+// Writer appends to the sub-log of the local region, stamping every record
+// with a timestamp of its clock.
+type Writer struct {
+	mu    sync.Mutex
+	wal   s3_log.WAL
+	clock *Clock
+}
+
+// NewWriter returns a writer for the sub-log of the local region. It reads the
+// last record of the sub-log first, so that a restarted writer never stamps a
+// record before the ones it wrote already, even if the physical clock went
+// backwards.
+func NewWriter(ctx context.Context, local s3_log.WAL, clock *Clock) (*Writer, error) {
+	last, err := local.LastRecord(ctx)
+	if err != nil && !errors.Is(err, s3_log.ErrEmpty) {
+		return nil, err
+	}
+	if err == nil {
+		_, ts, _, err := decode(last.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode record at offset %d: %w", last.Offset, err)
+		}
+		clock.Update(ts)
+	}
+	return &Writer{wal: local, clock: clock}, nil
+}
+
+// Append appends data to the local sub-log. Appends are serialized, so that
+// timestamps increase with offsets, which the watermarks rely on.
+func (w *Writer) Append(ctx context.Context, data []byte) (uint64, Timestamp, error) {
+	return w.append(ctx, kindRecord, data)
+}
+
+// Heartbeat appends an empty record that only advances the watermark of the
+// region. A region that has nothing to write must send heartbeats, or the
+// merged view never becomes stable past its last record.
+func (w *Writer) Heartbeat(ctx context.Context) (Timestamp, error) {
+	_, ts, err := w.append(ctx, kindHeartbeat, nil)
+	return ts, err
+}
+
+func (w *Writer) append(ctx context.Context, kind byte, data []byte) (uint64, Timestamp, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ts := w.clock.Now()
+	offset, err := w.wal.Append(ctx, encode(kind, ts, data))
+	if err != nil {
+		return 0, Timestamp{}, err
+	}
+	return offset, ts, nil
+}
+
+type regionState struct {
+	name      string
+	wal       s3_log.WAL
+	next      uint64
+	watermark Timestamp
+	pending   []Entry
+}
+
+// Merger is the merged view of the sub-logs of all regions. It orders records
+// by timestamp, then region name, then offset, so every reader sees the same
+// order. A record is only handed out once it is stable, i.e. every region's
+// watermark, the timestamp of the last record read from it, has reached the
+// record's timestamp. Timestamps within a sub-log only increase, so no record
+// can later show up before a stable one.
+type Merger struct {
+	regions []*regionState
+	clock   *Clock
+}
+
+// NewMerger returns a merged view starting at the given offsets of each
+// region, as returned by Position. Regions missing from from start at their
+// first record. If clock is not nil, it is updated with every timestamp read,
+// so that a writer sharing it stamps its records after what it has seen.
+func NewMerger(regions []Region, from map[string]uint64, clock *Clock) *Merger {
+	m := &Merger{clock: clock}
+	for _, r := range regions {
+		m.regions = append(m.regions, &regionState{
+			name: r.Name,
+			wal:  r.WAL,
+			next: max(from[r.Name], 1),
+		})
+	}
+	slices.SortFunc(m.regions, func(a, b *regionState) int {
+		if a.name < b.name {
+			return -1
+		}
+		if a.name > b.name {
+			return 1
+		}
+		return 0
+	})
+	return m
+}
+
+// Poll reads the records appended to every sub-log since the last poll.
+func (m *Merger) Poll(ctx context.Context) error {
+	for _, r := range m.regions {
+		last, err := r.wal.LastRecord(ctx)
+		if errors.Is(err, s3_log.ErrEmpty) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll region %s: %w", r.name, err)
+		}
+		for ; r.next <= last.Offset; r.next++ {
+			record := last
+			if r.next != last.Offset {
+				if record, err = r.wal.Read(ctx, r.next); err != nil {
+					return fmt.Errorf("failed to read offset %d of region %s: %w", r.next, r.name, err)
+				}
+			}
+			kind, ts, data, err := decode(record.Data)
+			if err != nil {
+				return fmt.Errorf("failed to decode offset %d of region %s: %w", r.next, r.name, err)
+			}
+			if ts.Compare(r.watermark) <= 0 {
+				return fmt.Errorf("timestamp %s at offset %d of region %s does not advance past %s", ts, r.next, r.name, r.watermark)
+			}
+			r.watermark = ts
+			if m.clock != nil {
+				m.clock.Update(ts)
+			}
+			if kind == kindRecord {
+				r.pending = append(r.pending, Entry{Region: r.name, Offset: r.next, Timestamp: ts, Data: data})
+			}
+		}
+	}
+	return nil
+}
+
+// Watermark returns the timestamp up to which the merged view is stable.
+func (m *Merger) Watermark() Timestamp {
+	var wm Timestamp
+	for i, r := range m.regions {
+		if i == 0 || r.watermark.Compare(wm) < 0 {
+			wm = r.watermark
+		}
+	}
+	return wm
+}
+
+// Next returns the next stable entry of the merged view, or false if there is
+// none until the next Poll.
+func (m *Merger) Next() (Entry, bool) {
+	var head *regionState
+	for _, r := range m.regions {
+		// regions are sorted by name, so a strict comparison breaks ties by it
+		if len(r.pending) > 0 && (head == nil || r.pending[0].Timestamp.Compare(head.pending[0].Timestamp) < 0) {
+			head = r
+		}
+	}
+	if head == nil || head.pending[0].Timestamp.Compare(m.Watermark()) > 0 {
+		return Entry{}, false
+	}
+	e := head.pending[0]
+	head.pending = head.pending[1:]
+	return e, true
+}
+
+// Position returns the offset of every region to resume the merged view from
+// with NewMerger, right after the last entry returned by Next.
+func (m *Merger) Position() map[string]uint64 {
+	pos := make(map[string]uint64, len(m.regions))
+	for _, r := range m.regions {
+		pos[r.name] = r.next
+		if len(r.pending) > 0 {
+			pos[r.name] = r.pending[0].Offset
+		}
+	}
+	return pos
+}
+
+// Stream polls every interval and calls fn with each stable entry in order,
+// until fn or a poll fails or ctx is done.
+func (m *Merger) Stream(ctx context.Context, interval time.Duration, fn func(Entry) error) error {
+	for {
+		if err := m.Poll(ctx); err != nil {
+			return err
+		}
+		for {
+			e, ok := m.Next()
+			if !ok {
+				break
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package multiregion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+// fakeTime is a physical clock that only moves when told to
+type fakeTime struct {
+	now time.Time
+}
+
+func (f *fakeTime) Now() time.Time {
+	return f.now
+}
+
+func newWriter(t *testing.T, wal s3_log.WAL, clock *Clock) *Writer {
+	w, err := NewWriter(context.Background(), wal, clock)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	return w
+}
+
+func drain(m *Merger) []string {
+	var out []string
+	for {
+		e, ok := m.Next()
+		if !ok {
+			return out
+		}
+		out = append(out, fmt.Sprintf("%s:%s", e.Region, e.Data))
+	}
+}
+
+func TestMergedView(t *testing.T) {
+	ctx := context.Background()
+	eu, us := &waltest.MemWAL{}, &waltest.MemWAL{}
+	tm := &fakeTime{now: time.Unix(1000, 0)}
+	euWriter := newWriter(t, eu, NewClock(tm.Now))
+	usWriter := newWriter(t, us, NewClock(tm.Now))
+	regions := []Region{{Name: "us", WAL: us}, {Name: "eu", WAL: eu}}
+
+	euWriter.Append(ctx, []byte("e1"))
+	usWriter.Append(ctx, []byte("u1")) // same wall time and counter as e1
+	tm.now = tm.now.Add(time.Millisecond)
+	euWriter.Append(ctx, []byte("e2"))
+	tm.now = tm.now.Add(time.Millisecond)
+	euWriter.Append(ctx, []byte("e3"))
+
+	m := NewMerger(regions, nil, nil)
+	if err := m.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	// us has not written past u1, so e2 and e3 are not stable yet
+	if got := fmt.Sprint(drain(m)); got != "[eu:e1 us:u1]" {
+		t.Errorf("expected [eu:e1 us:u1], got %v", got)
+	}
+
+	if _, err := usWriter.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if err := m.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if got := fmt.Sprint(drain(m)); got != "[eu:e2 eu:e3]" {
+		t.Errorf("expected [eu:e2 eu:e3], got %v", got)
+	}
+
+	// a merger resuming from the position sees nothing twice, and one
+	// started from scratch sees the same order
+	tm.now = tm.now.Add(time.Millisecond)
+	usWriter.Append(ctx, []byte("u2"))
+	euWriter.Heartbeat(ctx)
+	resumed := NewMerger(regions, m.Position(), nil)
+	if err := resumed.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if got := fmt.Sprint(drain(resumed)); got != "[us:u2]" {
+		t.Errorf("expected [us:u2] after resuming, got %v", got)
+	}
+	fresh := NewMerger([]Region{regions[1], regions[0]}, nil, nil)
+	if err := fresh.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if got := fmt.Sprint(drain(fresh)); got != "[eu:e1 us:u1 eu:e2 eu:e3 us:u2]" {
+		t.Errorf("expected the full merged order, got %v", got)
+	}
+}
+
+func TestCausalOrder(t *testing.T) {
+	ctx := context.Background()
+	eu, us := &waltest.MemWAL{}, &waltest.MemWAL{}
+	euTime := &fakeTime{now: time.Unix(1000, 0)}
+	// the clock of us lags a whole second behind
+	usTime := &fakeTime{now: time.Unix(999, 0)}
+	euWriter := newWriter(t, eu, NewClock(euTime.Now))
+	usClock := NewClock(usTime.Now)
+	usWriter := newWriter(t, us, usClock)
+	regions := []Region{{Name: "eu", WAL: eu}, {Name: "us", WAL: us}}
+
+	euWriter.Append(ctx, []byte("question"))
+	// us reads the question through the merged view and replies
+	m := NewMerger(regions, nil, usClock)
+	if err := m.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	usWriter.Append(ctx, []byte("answer"))
+	euWriter.Heartbeat(ctx)
+
+	m = NewMerger(regions, nil, nil)
+	if err := m.Poll(ctx); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if got := fmt.Sprint(drain(m)); got != "[eu:question us:answer]" {
+		t.Errorf("expected the answer after the question, got %v", got)
+	}
+
+	// a restarted writer continues after its own last record
+	usTime.now = time.Unix(0, 0)
+	restarted := newWriter(t, us, NewClock(usTime.Now))
+	_, ts, err := restarted.Append(ctx, []byte("after restart"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if ts.WallTime != euTime.now.UnixNano() {
+		t.Errorf("expected restarted writer to continue from %d, got %s", euTime.now.UnixNano(), ts)
+	}
+}
+
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eu, us := &waltest.MemWAL{}, &waltest.MemWAL{}
+	tm := &fakeTime{now: time.Unix(1000, 0)}
+	euWriter := newWriter(t, eu, NewClock(tm.Now))
+	usWriter := newWriter(t, us, NewClock(tm.Now))
+	for i := 0; i < 3; i++ {
+		tm.now = tm.now.Add(time.Millisecond)
+		euWriter.Append(ctx, []byte(fmt.Sprint("e", i)))
+		usWriter.Append(ctx, []byte(fmt.Sprint("u", i)))
+	}
+
+	m := NewMerger([]Region{{Name: "eu", WAL: eu}, {Name: "us", WAL: us}}, nil, nil)
+	var got []string
+	err := m.Stream(ctx, time.Millisecond, func(e Entry) error {
+		got = append(got, string(e.Data))
+		if len(got) == 6 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if fmt.Sprint(got) != "[e0 u0 e1 u1 e2 u2]" {
+		t.Errorf("expected interleaved stream, got %v", got)
+	}
+}
@@ -0,0 +1,165 @@
+package projection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+const defaultBatchSize = 100
+
+// Handler applies a single record to the read model. It must only write
+// through tx, so that its changes commit together with the offset.
+type Handler func(ctx context.Context, tx *sql.Tx, record s3_log.Record) error
+
+// Runner materialises a log into a local SQLite database. The offset of the
+// last applied record is stored in the same database and updated in the same
+// transaction as the changes made by the handler, so every record is applied
+// exactly once even if the process crashes halfway.
+type Runner struct {
+	db        *sql.DB
+	wal       s3_log.WAL
+	name      string
+	handler   Handler
+	batchSize int
+}
+
+func NewRunner(db *sql.DB, wal s3_log.WAL, name string, handler Handler, batchSize int) *Runner {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	return &Runner{
+		db:        db,
+		wal:       wal,
+		name:      name,
+		handler:   handler,
+		batchSize: batchSize,
+	}
+}
+
+// Init creates the table that tracks applied offsets. It is safe to call on
+// every start.
+func (r *Runner) Init(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS s3log_projections (
+		name TEXT PRIMARY KEY,
+		last_offset INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create projections table: %w", err)
+	}
+	return nil
+}
+
+// LastApplied returns the offset of the last record applied, or 0 if none
+// has been applied yet.
+func (r *Runner) LastApplied(ctx context.Context) (uint64, error) {
+	return lastApplied(ctx, r.db, r.name)
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func lastApplied(ctx context.Context, q queryer, name string) (uint64, error) {
+	var offset int64
+	err := q.QueryRowContext(ctx, `SELECT last_offset FROM s3log_projections WHERE name = ?`, name).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last applied offset: %w", err)
+	}
+	return uint64(offset), nil
+}
+
+func setLastApplied(ctx context.Context, tx *sql.Tx, name string, offset uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO s3log_projections (name, last_offset) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_offset = excluded.last_offset`, name, int64(offset))
+	if err != nil {
+		return fmt.Errorf("failed to set last applied offset: %w", err)
+	}
+	return nil
+}
+
+// CatchUp applies every record after the last applied one up to the end of
+// the log, and returns the new last applied offset.
+func (r *Runner) CatchUp(ctx context.Context) (uint64, error) {
+	last, err := r.LastApplied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tail, err := r.wal.LastRecord(ctx)
+	if errors.Is(err, s3_log.ErrEmpty) {
+		return last, nil
+	}
+	if err != nil {
+		return last, fmt.Errorf("failed to get last record: %w", err)
+	}
+
+	for last < tail.Offset {
+		end := min(last+uint64(r.batchSize), tail.Offset)
+		if err = r.applyBatch(ctx, last+1, end); err != nil {
+			return last, err
+		}
+		last = end
+	}
+	return last, nil
+}
+
+func (r *Runner) applyBatch(ctx context.Context, from, to uint64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// another runner on the same database may have applied this batch already
+	last, err := lastApplied(ctx, tx, r.name)
+	if err != nil {
+		return err
+	}
+	if last != from-1 {
+		return fmt.Errorf("projection %s moved to offset %d, expected %d", r.name, last, from-1)
+	}
+	for offset := from; offset <= to; offset++ {
+		record, err := r.wal.Read(ctx, offset)
+		if err != nil {
+			return fmt.Errorf("failed to read offset %d: %w", offset, err)
+		}
+		if err = r.handler(ctx, tx, record); err != nil {
+			return fmt.Errorf("failed to apply offset %d: %w", offset, err)
+		}
+	}
+	if err = setLastApplied(ctx, tx, r.name, to); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Rebuild throws away the read model and applies the log again from the
+// start. reset must drop or clear the tables the handler writes to; it runs
+// in the same transaction that resets the offset, so a crash never leaves a
+// half reset read model behind.
+func (r *Runner) Rebuild(ctx context.Context, reset func(ctx context.Context, tx *sql.Tx) error) (uint64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err = reset(ctx, tx); err != nil {
+		return 0, fmt.Errorf("failed to reset projection: %w", err)
+	}
+	if err = setLastApplied(ctx, tx, r.name, 0); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return r.CatchUp(ctx)
+}
@@ -0,0 +1,116 @@
+package projection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+type deposit struct {
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+}
+
+func applyDeposit(ctx context.Context, tx *sql.Tx, record s3_log.Record) error {
+	var d deposit
+	if err := json.Unmarshal(record.Data, &d); err != nil {
+		return err
+	}
+	if d.Amount < 0 {
+		return errors.New("negative deposit")
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO balances (account, amount) VALUES (?, ?)
+		ON CONFLICT (account) DO UPDATE SET amount = amount + excluded.amount`, d.Account, d.Amount)
+	return err
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "projection.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err = db.Exec(`CREATE TABLE balances (account TEXT PRIMARY KEY, amount INTEGER NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func balance(t *testing.T, db *sql.DB, account string) int {
+	var amount int
+	if err := db.QueryRow(`SELECT amount FROM balances WHERE account = ?`, account).Scan(&amount); err != nil {
+		t.Fatalf("failed to get balance of %s: %v", account, err)
+	}
+	return amount
+}
+
+func TestRunner(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	wal := &waltest.MemWAL{}
+	runner := NewRunner(db, wal, "balances", applyDeposit, 2)
+	if err := runner.Init(ctx); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+
+	last, err := runner.CatchUp(ctx)
+	if err != nil || last != 0 {
+		t.Fatalf("expected catch up on empty log to be a no-op, got %d, %v", last, err)
+	}
+
+	for _, d := range []string{
+		`{"account":"alice","amount":10}`,
+		`{"account":"bob","amount":5}`,
+		`{"account":"alice","amount":7}`,
+	} {
+		wal.Append(ctx, []byte(d))
+	}
+	if last, err = runner.CatchUp(ctx); err != nil || last != 3 {
+		t.Fatalf("expected to catch up to 3, got %d, %v", last, err)
+	}
+	if got := balance(t, db, "alice"); got != 17 {
+		t.Errorf("expected alice to have 17, got %d", got)
+	}
+
+	// a failing record rolls back its whole batch and is retried next time
+	wal.Append(ctx, []byte(`{"account":"bob","amount":1}`))
+	wal.Append(ctx, []byte(`{"account":"bob","amount":-1}`))
+	if _, err = runner.CatchUp(ctx); err == nil {
+		t.Fatal("expected handler error, got nil")
+	}
+	if last, _ = runner.LastApplied(ctx); last != 3 {
+		t.Errorf("expected last applied to stay at 3, got %d", last)
+	}
+	if got := balance(t, db, "bob"); got != 5 {
+		t.Errorf("expected bob to still have 5, got %d", got)
+	}
+	wal.Set(5, []byte(`{"account":"bob","amount":2}`))
+	if last, err = runner.CatchUp(ctx); err != nil || last != 5 {
+		t.Fatalf("expected to catch up to 5, got %d, %v", last, err)
+	}
+	if got := balance(t, db, "bob"); got != 8 {
+		t.Errorf("expected bob to have 8, got %d", got)
+	}
+
+	last, err = runner.Rebuild(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM balances`)
+		return err
+	})
+	if err != nil || last != 5 {
+		t.Fatalf("expected rebuild to reach 5, got %d, %v", last, err)
+	}
+	if got := balance(t, db, "alice"); got != 17 {
+		t.Errorf("expected alice to have 17 after rebuild, got %d", got)
+	}
+	if got := balance(t, db, "bob"); got != 8 {
+		t.Errorf("expected bob to have 8 after rebuild, got %d", got)
+	}
+}
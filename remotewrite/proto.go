@@ -0,0 +1,168 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WriteRequest mirrors the parts of prometheus.WriteRequest that carry
+// samples. Metadata, exemplars and native histograms are skipped when
+// decoding.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value float64
+	// Timestamp is in milliseconds since the epoch
+	Timestamp int64
+}
+
+// DecodeWriteRequest decodes an uncompressed WriteRequest. Concatenated
+// WriteRequests decode as one holding all their series, which is how
+// batches are stored.
+func DecodeWriteRequest(b []byte) (*WriteRequest, error) {
+	req := &WriteRequest{}
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return -1, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		ts, err := decodeTimeSeries(v)
+		if err != nil {
+			return 0, err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+		return n, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid WriteRequest: %w", err)
+	}
+	return req, nil
+}
+
+func decodeTimeSeries(b []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return -1, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 1 {
+			l, err := decodeLabel(v)
+			ts.Labels = append(ts.Labels, l)
+			return n, err
+		}
+		s, err := decodeSample(v)
+		ts.Samples = append(ts.Samples, s)
+		return n, err
+	})
+	return ts, err
+}
+
+func decodeLabel(b []byte) (Label, error) {
+	var l Label
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return -1, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if num == 1 {
+			l.Name = string(v)
+		} else {
+			l.Value = string(v)
+		}
+		return n, nil
+	})
+	return l, err
+}
+
+func decodeSample(b []byte) (Sample, error) {
+	var s Sample
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			s.Value = math.Float64frombits(v)
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			s.Timestamp = int64(v)
+			return n, nil
+		}
+		return -1, nil
+	})
+	return s, err
+}
+
+// decodeFields walks the fields of a message and calls fn with the bytes
+// after each tag. fn returns how many bytes it consumed, a negative protowire
+// error code, or -1 to skip a field it does not know.
+func decodeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if m == -1 {
+			m = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// EncodeWriteRequest is the inverse of DecodeWriteRequest.
+func EncodeWriteRequest(req *WriteRequest) []byte {
+	var b []byte
+	for _, ts := range req.Timeseries {
+		var tsb []byte
+		for _, l := range ts.Labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Value)
+			tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, lb)
+		}
+		for _, s := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+			tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, sb)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, tsb)
+	}
+	return b
+}
@@ -0,0 +1,292 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+const (
+	maxBodySize = 32 << 20
+	// maxDecodedSize bounds the memory a single request can make us allocate,
+	// since snappy's header claims whatever length the client likes
+	maxDecodedSize = 128 << 20
+)
+
+var ErrClosed = errors.New("receiver is closed")
+
+type pendingWrite struct {
+	data []byte
+	done chan error
+}
+
+// Receiver is a Prometheus remote-write endpoint that archives samples in a
+// log. Concurrent WriteRequests are batched into a single record for up to
+// flushInterval or maxBatchBytes, and each request is answered once its
+// batch is in S3, so Prometheus retries anything that did not make it.
+//
+// A record holds the snappy-compressed concatenation of the batched
+// WriteRequests, which is itself a valid remote-write body.
+type Receiver struct {
+	wal           s3_log.WAL
+	mu            sync.Mutex
+	flushInterval time.Duration
+	maxBatchBytes int
+	pending       chan pendingWrite
+	closeOnce     sync.Once
+	closed        chan struct{}
+	stopped       chan struct{}
+}
+
+func NewReceiver(wal s3_log.WAL, flushInterval time.Duration, maxBatchBytes int) *Receiver {
+	r := &Receiver{
+		wal:           wal,
+		flushInterval: flushInterval,
+		maxBatchBytes: maxBatchBytes,
+		pending:       make(chan pendingWrite),
+		closed:        make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// SetBatching changes how requests are batched, starting with the next batch.
+func (r *Receiver) SetBatching(flushInterval time.Duration, maxBatchBytes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushInterval = flushInterval
+	r.maxBatchBytes = maxBatchBytes
+}
+
+// Close stops batching after flushing what is pending.
+func (r *Receiver) Close() {
+	r.closeOnce.Do(func() { close(r.closed) })
+	<-r.stopped
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		// a 4xx other than 429 makes Prometheus drop the request, which is
+		// all we can do with one this large
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		http.Error(w, "failed to decompress body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if size > maxDecodedSize {
+		http.Error(w, fmt.Sprintf("decompressed body of %d bytes is over the limit of %d", size, maxDecodedSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "failed to decompress body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err = DecodeWriteRequest(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := pendingWrite{data: data, done: make(chan error, 1)}
+	select {
+	case r.pending <- p:
+	case <-r.closed:
+		http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+		return
+	case <-req.Context().Done():
+		return
+	}
+	if err = <-p.done; err != nil {
+		// a 5xx makes Prometheus retry the request
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Receiver) run() {
+	defer close(r.stopped)
+	for {
+		var batch []pendingWrite
+		select {
+		case p := <-r.pending:
+			batch = append(batch, p)
+		case <-r.closed:
+			return
+		}
+
+		r.mu.Lock()
+		flushInterval, maxBatchBytes := r.flushInterval, r.maxBatchBytes
+		r.mu.Unlock()
+		size := len(batch[0].data)
+		timer := time.NewTimer(flushInterval)
+	collect:
+		for size < maxBatchBytes {
+			select {
+			case p := <-r.pending:
+				batch = append(batch, p)
+				size += len(p.data)
+			case <-timer.C:
+				break collect
+			case <-r.closed:
+				break collect
+			}
+		}
+		timer.Stop()
+		r.flush(batch)
+	}
+}
+
+func (r *Receiver) flush(batch []pendingWrite) {
+	var buf bytes.Buffer
+	for _, p := range batch {
+		buf.Write(p.data)
+	}
+	_, err := r.wal.Append(context.Background(), snappy.Encode(nil, buf.Bytes()))
+	if err != nil {
+		err = fmt.Errorf("failed to append batch: %w", err)
+	}
+	for _, p := range batch {
+		p.done <- err
+	}
+}
+
+// DecodeRecord decodes a record written by Receiver.
+func DecodeRecord(record s3_log.Record) (*WriteRequest, error) {
+	data, err := snappy.Decode(nil, record.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	return DecodeWriteRequest(data)
+}
+
+// Push sends a record written by Receiver to a remote-write endpoint as is,
+// to backfill a TSDB.
+func Push(ctx context.Context, client *http.Client, url string, record s3_log.Record) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(record.Data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push offset %d: %w", record.Offset, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to push offset %d: %s", record.Offset, resp.Status)
+	}
+	return nil
+}
+
+// WriteOpenMetrics writes the samples of reqs in the OpenMetrics text
+// format, which `promtool tsdb create-blocks-from openmetrics` can backfill
+// from. Series are grouped by metric name and every metric is typed unknown,
+// since remote-write does not carry types.
+func WriteOpenMetrics(w io.Writer, reqs ...*WriteRequest) error {
+	type line struct {
+		labels    string
+		value     float64
+		timestamp int64
+	}
+	families := make(map[string][]line)
+	for _, req := range reqs {
+		for _, ts := range req.Timeseries {
+			name, labels := formatLabels(ts.Labels)
+			for _, s := range ts.Samples {
+				families[name] = append(families[name], line{labels, s.Value, s.Timestamp})
+			}
+		}
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		lines := families[name]
+		// OpenMetrics wants the samples of a series in time order
+		sort.SliceStable(lines, func(i, j int) bool {
+			if lines[i].labels != lines[j].labels {
+				return lines[i].labels < lines[j].labels
+			}
+			return lines[i].timestamp < lines[j].timestamp
+		})
+		fmt.Fprintf(&sb, "# TYPE %s unknown\n", name)
+		for _, l := range lines {
+			fmt.Fprintf(&sb, "%s%s %s %s\n", name, l.labels, formatFloat(l.value),
+				strconv.FormatFloat(float64(l.timestamp)/1000, 'f', -1, 64))
+		}
+	}
+	sb.WriteString("# EOF\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the metric name and the other labels as {a="b",...}
+func formatLabels(labels []Label) (string, string) {
+	var name string
+	var rest []Label
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		rest = append(rest, l)
+	}
+	if len(rest) == 0 {
+		return name, ""
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Name < rest[j].Name })
+	parts := make([]string, len(rest))
+	for i, l := range rest {
+		parts[i] = l.Name + `="` + labelValueEscaper.Replace(l.Value) + `"`
+	}
+	return name, "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,175 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func series(name, instance string, value float64, ts int64) TimeSeries {
+	return TimeSeries{
+		Labels:  []Label{{"__name__", name}, {"instance", instance}},
+		Samples: []Sample{{Value: value, Timestamp: ts}},
+	}
+}
+
+func post(t *testing.T, url string, req *WriteRequest) int {
+	body := snappy.Encode(nil, EncodeWriteRequest(req))
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReceiverBatchesRequests(t *testing.T) {
+	wal := &waltest.MemWAL{}
+	receiver := NewReceiver(wal, 200*time.Millisecond, 1<<20)
+	defer receiver.Close()
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &WriteRequest{Timeseries: []TimeSeries{series("up", fmt.Sprintf("host-%d", i), 1, 1700000000000)}}
+			if code := post(t, server.URL, req); code != http.StatusNoContent {
+				t.Errorf("expected 204, got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if wal.Len() != 1 {
+		t.Fatalf("expected 5 requests to be batched into 1 record, got %d", wal.Len())
+	}
+	record, err := wal.Read(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := DecodeRecord(record)
+	if err != nil {
+		t.Fatalf("failed to decode record: %v", err)
+	}
+	if len(req.Timeseries) != 5 {
+		t.Errorf("expected 5 series in the batch, got %d", len(req.Timeseries))
+	}
+
+	resp, err := http.Post(server.URL, "application/x-protobuf", strings.NewReader("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid body, got %d", resp.StatusCode)
+	}
+}
+
+func TestReceiverRejectsLargeBodies(t *testing.T) {
+	wal := &waltest.MemWAL{}
+	receiver := NewReceiver(wal, 10*time.Millisecond, 1<<20)
+	defer receiver.Close()
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// too large on the wire
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader(make([]byte, maxBodySize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body over the limit, got %d", resp.StatusCode)
+	}
+
+	// a snappy header claiming more than we are willing to allocate
+	header := binary.AppendUvarint(nil, maxDecodedSize+1)
+	resp, err = http.Post(server.URL, "application/x-protobuf", bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a decoded size over the limit, got %d", resp.StatusCode)
+	}
+	if wal.Len() != 0 {
+		t.Errorf("expected nothing to be appended, got %d records", wal.Len())
+	}
+}
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	req := &WriteRequest{Timeseries: []TimeSeries{
+		series("up", "a", 1, 1000),
+		{Labels: []Label{{"__name__", "temp"}}, Samples: []Sample{{-3.5, 2000}, {4, 3000}}},
+	}}
+	got, err := DecodeWriteRequest(EncodeWriteRequest(req))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("round trip mismatch: expected %+v, got %+v", req, got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	req := &WriteRequest{Timeseries: []TimeSeries{
+		series("up", "b", 0, 1700000001500),
+		series("up", "a", 1, 1700000000000),
+		{Labels: []Label{{"__name__", "temp"}, {"room", `kitchen "1"`}}, Samples: []Sample{{21.5, 1700000000000}}},
+	}}
+	record := s3_log.Record{Offset: 1, Data: snappy.Encode(nil, EncodeWriteRequest(req))}
+
+	var buf bytes.Buffer
+	decoded, err := DecodeRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteOpenMetrics(&buf, decoded); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE temp unknown
+temp{room="kitchen \"1\""} 21.5 1700000000
+# TYPE up unknown
+up{instance="a"} 1 1700000000
+up{instance="b"} 0 1700000001.5
+# EOF
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected OpenMetrics output:\n%s", buf.String())
+	}
+
+	var pushed []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("expected snappy encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+		buf.Reset()
+		buf.ReadFrom(r.Body)
+		pushed = buf.Bytes()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	if err = Push(context.Background(), http.DefaultClient, server.URL, record); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	if !bytes.Equal(pushed, record.Data) {
+		t.Error("expected the record to be pushed as is")
+	}
+}
@@ -5,12 +5,36 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// sealedMetadataKey marks the object at the end of a sealed log. The body of
+// that object holds the successor prefix, which may be empty, and
+// successorBucketMetadataKey holds the successor bucket if it is a different
+// one. migratedMetadataKey is set when the successor is a copy made by
+// Migrate.
+const (
+	sealedMetadataKey          = "s3log-sealed"
+	successorBucketMetadataKey = "s3log-successor-bucket"
+	migratedMetadataKey        = "s3log-migrated"
+)
+
+var (
+	ErrEmpty          = errors.New("WAL is empty")
+	ErrSealed         = errors.New("WAL is sealed")
+	ErrOffsetConflict = errors.New("WAL does not end at the expected offset")
 )
 
 type S3WAL struct {
@@ -18,6 +42,16 @@ type S3WAL struct {
 	bucketName string
 	prefix     string
 	length     uint64
+	sealed     bool
+	versioned  bool
+	// versions caches the VersionId of records appended or read so far. It
+	// is only a cache, a WAL without it finds the versions by listing them.
+	versionsMu sync.Mutex
+	versions   map[uint64]string
+	lease      *Lease
+	// observed is the highest offset WaitForOffset has seen, which unlike
+	// length is safe to use from concurrent readers
+	observed atomic.Uint64
 }
 
 func NewS3WAL(client *s3.Client, bucketName, prefix string) *S3WAL {
@@ -34,8 +68,11 @@ func (w *S3WAL) getObjectKey(offset uint64) string {
 }
 
 func (w *S3WAL) getOffsetFromKey(key string) (uint64, error) {
-	// skip the `w.prefix` and "/"
-	numStr := key[len(w.prefix)+1:]
+	// keys of other logs sharing the bucket are rejected rather than parsed
+	numStr, ok := strings.CutPrefix(key, w.prefix+"/")
+	if !ok {
+		return 0, fmt.Errorf("key %q is not under prefix %q", key, w.prefix)
+	}
 	return strconv.ParseUint(numStr, 10, 64)
 }
 
@@ -50,6 +87,26 @@ func validateChecksum(data []byte) bool {
 	return storedChecksum == calculateChecksum(bytes.NewBuffer(recordData))
 }
 
+// decodeBody is the inverse of prepareBody. It checks that the body belongs
+// at offset and that it is intact, and never reads outside of data.
+func decodeBody(offset uint64, data []byte) (Record, error) {
+	// 8 bytes for offset and 32 bytes for checksum, data may be empty
+	if len(data) < 8+32 {
+		return Record{}, fmt.Errorf("invalid record: data too short")
+	}
+	storedOffset := binary.BigEndian.Uint64(data[:8])
+	if storedOffset != offset {
+		return Record{}, fmt.Errorf("offset mismatch: expected %d, got %d", offset, storedOffset)
+	}
+	if !validateChecksum(data) {
+		return Record{}, fmt.Errorf("checksum mismatch")
+	}
+	return Record{
+		Offset: storedOffset,
+		Data:   data[8 : len(data)-32],
+	}, nil
+}
+
 func prepareBody(offset uint64, data []byte) ([]byte, error) {
 	// 8 bytes for offset, len(data) bytes for data, 32 bytes for checksum
 	bufferLen := 8 + len(data) + 32
@@ -66,6 +123,20 @@ func prepareBody(offset uint64, data []byte) ([]byte, error) {
 }
 
 func (w *S3WAL) Append(ctx context.Context, data []byte) (uint64, error) {
+	return w.AppendWithMetadata(ctx, data, nil)
+}
+
+// AppendWithMetadata appends data and stores metadata as x-amz-meta-* headers
+// of the record object, so that it can be looked at with HeadRecord without
+// fetching the body. Keys are case insensitive and must not start with
+// "s3log-", which is reserved.
+func (w *S3WAL) AppendWithMetadata(ctx context.Context, data []byte, metadata map[string]string) (uint64, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := validateMetadata(metadata); err != nil {
+		return 0, err
+	}
 	nextOffset := w.length + 1
 
 	buf, err := prepareBody(nextOffset, data)
@@ -78,79 +149,393 @@ func (w *S3WAL) Append(ctx context.Context, data []byte) (uint64, error) {
 		Key:         aws.String(w.getObjectKey(nextOffset)),
 		Body:        bytes.NewReader(buf),
 		IfNoneMatch: aws.String("*"),
+		Metadata:    metadata,
 	}
 
-	if _, err = w.client.PutObject(ctx, input); err != nil {
+	output, err := w.client.PutObject(ctx, input)
+	if err != nil {
 		return 0, fmt.Errorf("failed to put object to S3: %w", err)
 	}
+	w.recordVersion(nextOffset, output)
 	w.length = nextOffset
 	return nextOffset, nil
 }
 
+// AppendIfTail appends data only if the log currently ends at expectedLast,
+// with 0 meaning an empty log. If it does not, it returns the actual last
+// offset along with ErrOffsetConflict, and leaves the WAL state untouched so
+// the caller can decide what to do.
+func (w *S3WAL) AppendIfTail(ctx context.Context, expectedLast uint64, data []byte) (uint64, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+	// the conditional put only proves that expectedLast+1 is free, so we also
+	// need expectedLast to exist unless we wrote or saw it ourselves
+	if expectedLast > w.length {
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(w.bucketName),
+			Key:    aws.String(w.getObjectKey(expectedLast)),
+		}
+		result, err := w.client.HeadObject(ctx, input)
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return w.offsetConflict(ctx, expectedLast)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to head object from S3: %w", err)
+		}
+		if isSealMarker(result.Metadata) {
+			return 0, ErrSealed
+		}
+	}
+	nextOffset := expectedLast + 1
+
+	buf, err := prepareBody(nextOffset, data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare object body: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(w.bucketName),
+		Key:         aws.String(w.getObjectKey(nextOffset)),
+		Body:        bytes.NewReader(buf),
+		IfNoneMatch: aws.String("*"),
+	}
+
+	output, err := w.client.PutObject(ctx, input)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return w.offsetConflict(ctx, expectedLast)
+		}
+		return 0, fmt.Errorf("failed to put object to S3: %w", err)
+	}
+	w.recordVersion(nextOffset, output)
+	w.length = nextOffset
+	return nextOffset, nil
+}
+
+// UseLease makes every write to the log fail with ErrLeaseLost unless lease
+// is held, so that a writer that lost the lease stops appending.
+func (w *S3WAL) UseLease(lease *Lease) {
+	w.lease = lease
+}
+
+func (w *S3WAL) checkWritable() error {
+	if w.sealed {
+		return ErrSealed
+	}
+	if w.lease != nil && !w.lease.Held() {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (w *S3WAL) offsetConflict(ctx context.Context, expectedLast uint64) (uint64, error) {
+	actual, err := w.lastOffset(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return actual, fmt.Errorf("%w: expected %d, got %d", ErrOffsetConflict, expectedLast, actual)
+}
+
 func (w *S3WAL) Read(ctx context.Context, offset uint64) (Record, error) {
+	record, _, err := w.ReadWithInfo(ctx, offset)
+	return record, err
+}
+
+// ReadWithInfo is Read that also returns the details of the record object.
+func (w *S3WAL) ReadWithInfo(ctx context.Context, offset uint64) (Record, RecordInfo, error) {
+	record, info, err := w.read(ctx, offset)
+	if err != nil {
+		return Record{}, RecordInfo{}, err
+	}
+	if isSealMarker(info.Metadata) {
+		return Record{}, RecordInfo{}, ErrSealed
+	}
+	return record, info, nil
+}
+
+// read fetches the object at offset along with its details, whose user
+// metadata tells records apart from the seal marker
+func (w *S3WAL) read(ctx context.Context, offset uint64) (Record, RecordInfo, error) {
 	key := w.getObjectKey(offset)
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(w.bucketName),
 		Key:    aws.String(key),
 	}
+	if w.versioned {
+		version, err := w.originalVersion(ctx, offset)
+		if err != nil {
+			return Record{}, RecordInfo{}, err
+		}
+		input.VersionId = aws.String(version)
+	}
 
 	result, err := w.client.GetObject(ctx, input)
 	if err != nil {
-		return Record{}, fmt.Errorf("failed to get object from S3: %w", err)
+		return Record{}, RecordInfo{}, fmt.Errorf("failed to get object from S3: %w", err)
 	}
 	defer result.Body.Close()
 
 	data, err := io.ReadAll(result.Body)
 	if err != nil {
-		return Record{}, fmt.Errorf("failed to read object body: %w", err)
+		return Record{}, RecordInfo{}, fmt.Errorf("failed to read object body: %w", err)
 	}
-	if len(data) < 40 {
-		return Record{}, fmt.Errorf("invalid record: data too short")
+	record, err := decodeBody(offset, data)
+	if err != nil {
+		return Record{}, RecordInfo{}, err
 	}
+	return record, RecordInfo{
+		ETag:         aws.ToString(result.ETag),
+		LastModified: aws.ToTime(result.LastModified),
+		Size:         aws.ToInt64(result.ContentLength),
+		VersionID:    aws.ToString(result.VersionId),
+		Metadata:     result.Metadata,
+	}, nil
+}
 
-	var storedOffset uint64
-	if err = binary.Read(bytes.NewReader(data[:8]), binary.BigEndian, &storedOffset); err != nil {
+func (w *S3WAL) LastRecord(ctx context.Context) (Record, error) {
+	maxOffset, err := w.lastOffset(ctx)
+	if err != nil {
 		return Record{}, err
 	}
-	if storedOffset != offset {
-		return Record{}, fmt.Errorf("offset mismatch: expected %d, got %d", offset, storedOffset)
+	if maxOffset == 0 {
+		return Record{}, ErrEmpty
 	}
-	if !validateChecksum(data) {
-		return Record{}, fmt.Errorf("checksum mismatch")
+	w.length = maxOffset
+	record, info, err := w.read(ctx, maxOffset)
+	if err != nil || !isSealMarker(info.Metadata) {
+		return record, err
 	}
-	return Record{
-		Offset: storedOffset,
-		Data:   data[8 : len(data)-32],
-	}, nil
+	// the last object is the seal marker, so the last record is the one before it
+	w.sealed = true
+	if maxOffset == 1 {
+		return Record{}, ErrEmpty
+	}
+	return w.Read(ctx, maxOffset-1)
 }
 
-func (w *S3WAL) LastRecord(ctx context.Context) (Record, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(w.bucketName),
-		Prefix: aws.String(w.prefix + "/"),
+// LastOffset returns the offset of the last record, not counting the seal
+// marker, or 0 if there is none. It does not move the offset Append writes
+// to, which LastRecord does.
+func (w *S3WAL) LastOffset(ctx context.Context) (uint64, error) {
+	offset, err := w.lastOffset(ctx)
+	if err != nil || offset == 0 {
+		return 0, err
 	}
-	paginator := s3.NewListObjectsV2Paginator(w.client, input)
+	_, err = w.HeadRecord(ctx, offset)
+	if errors.Is(err, ErrSealed) {
+		return offset - 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
 
-	var maxOffset uint64 = 0
-	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(ctx)
+// lastOffset returns the highest offset in the log, which may be the seal
+// marker, or 0 if it is empty.
+// Keys sort like their offsets, so instead of listing the whole log it
+// searches for the highest key by asking whether there is any key after a
+// given one, which takes a number of single key listings logarithmic in the
+// length of the log.
+func (w *S3WAL) lastOffset(ctx context.Context) (uint64, error) {
+	found, err := w.hasAfter(ctx, 0)
+	if err != nil || !found {
+		return 0, err
+	}
+	// there is a key after lo and none after hi
+	lo, hi := uint64(0), uint64(1)
+	for {
+		found, err = w.hasAfter(ctx, hi)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			break
+		}
+		lo = hi
+		if hi > math.MaxUint64/2 {
+			hi = math.MaxUint64
+		} else {
+			hi *= 2
+		}
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		found, err = w.hasAfter(ctx, mid)
 		if err != nil {
-			return Record{}, fmt.Errorf("failed to list objects from S3: %w", err)
+			return 0, err
 		}
-		for _, obj := range output.Contents {
-			key := *obj.Key
-			offset, err := w.getOffsetFromKey(key)
+		if found {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// Seal writes an end-of-log marker at the next offset, after which no append
+// to this log can succeed. The marker is written with the same conditional put
+// as Append, so it fails if another writer got to the offset first. successor
+// is the prefix of the log that continues this one, or empty if there is none.
+func (w *S3WAL) Seal(ctx context.Context, successor string) (uint64, error) {
+	return w.seal(ctx, w.bucketName, successor, false)
+}
+
+func (w *S3WAL) seal(ctx context.Context, successorBucket, successor string, migrated bool) (uint64, error) {
+	if err := w.checkWritable(); err != nil {
+		return 0, err
+	}
+	nextOffset := w.length + 1
+
+	buf, err := prepareBody(nextOffset, []byte(successor))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare object body: %w", err)
+	}
+
+	metadata := map[string]string{sealedMetadataKey: "true"}
+	if successorBucket != w.bucketName {
+		metadata[successorBucketMetadataKey] = successorBucket
+	}
+	if migrated {
+		metadata[migratedMetadataKey] = "true"
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(w.bucketName),
+		Key:         aws.String(w.getObjectKey(nextOffset)),
+		Body:        bytes.NewReader(buf),
+		IfNoneMatch: aws.String("*"),
+		Metadata:    metadata,
+	}
+
+	if _, err = w.client.PutObject(ctx, input); err != nil {
+		return 0, fmt.Errorf("failed to put seal marker to S3: %w", err)
+	}
+	w.length = nextOffset
+	w.sealed = true
+	return nextOffset, nil
+}
+
+// Successor returns the log that continues this one once it is sealed. It
+// returns nil if the log is not sealed or was sealed without a successor.
+// The returned log is not initialised; call LastRecord before appending to it.
+//
+// The successor named by Seal is a new log that starts at offset 1, while
+// the destination of Migrate holds a copy of this log and continues at the
+// offset of the seal marker. ChainReader takes care of the difference.
+func (w *S3WAL) Successor(ctx context.Context) (*S3WAL, error) {
+	if !w.sealed {
+		return nil, nil
+	}
+	successor, _, err := w.successorAt(ctx, w.length)
+	return successor, err
+}
+
+// successorAt returns the successor named by the seal marker at offset and
+// the first offset of the successor that continues this log
+func (w *S3WAL) successorAt(ctx context.Context, offset uint64) (*S3WAL, uint64, error) {
+	record, info, err := w.read(ctx, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read seal marker: %w", err)
+	}
+	if !isSealMarker(info.Metadata) {
+		return nil, 0, fmt.Errorf("offset %d is not a seal marker", offset)
+	}
+	if len(record.Data) == 0 {
+		return nil, 0, nil
+	}
+	bucketName := w.bucketName
+	if bucket, ok := info.Metadata[successorBucketMetadataKey]; ok {
+		bucketName = bucket
+	}
+	next := uint64(1)
+	if info.Metadata[migratedMetadataKey] == "true" {
+		next = offset
+	}
+	return NewS3WAL(w.client, bucketName, string(record.Data)), next, nil
+}
+
+// Migrate copies this log into dst, which must be empty or hold a prefix of
+// this log from an earlier interrupted migration, while writers may still be
+// appending. The records dst already holds are checked against this log
+// before copying resumes after them. Records are copied along with their
+// metadata headers. Once dst has caught up, the log is
+// sealed with a marker that redirects to dst, which fences off every other
+// writer. The returned offset is the offset of that marker, and it is the
+// next offset dst will append at.
+func (w *S3WAL) Migrate(ctx context.Context, dst *S3WAL) (uint64, error) {
+	if _, err := w.LastRecord(ctx); err != nil && !errors.Is(err, ErrEmpty) {
+		return 0, err
+	}
+	if _, err := dst.LastRecord(ctx); err != nil && !errors.Is(err, ErrEmpty) {
+		return 0, fmt.Errorf("failed to get last record of destination: %w", err)
+	}
+	if dst.sealed {
+		return 0, fmt.Errorf("destination is sealed: %w", ErrSealed)
+	}
+	if dst.length > w.length {
+		return 0, fmt.Errorf("destination ends at offset %d, past the end of the log at %d", dst.length, w.length)
+	}
+	for offset := uint64(1); offset <= dst.length; offset++ {
+		if err := w.verifyCopy(ctx, dst, offset); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		if w.sealed {
+			return 0, ErrSealed
+		}
+		for dst.length < w.length {
+			record, info, err := w.ReadWithInfo(ctx, dst.length+1)
 			if err != nil {
-				return Record{}, fmt.Errorf("failed to parse offset from key: %w", err)
+				return 0, err
 			}
-			if offset > maxOffset {
-				maxOffset = offset
+			offset, err := dst.AppendWithMetadata(ctx, record.Data, userMetadata(info.Metadata))
+			if err != nil {
+				return 0, fmt.Errorf("failed to copy offset %d: %w", record.Offset, err)
 			}
+			if offset != record.Offset {
+				return 0, fmt.Errorf("offset mismatch: copied %d to %d", record.Offset, offset)
+			}
+		}
+
+		sealOffset, err := w.seal(ctx, dst.bucketName, dst.prefix, true)
+		if err == nil {
+			return sealOffset, nil
+		}
+		if !isPreconditionFailed(err) {
+			return 0, err
+		}
+		// a writer appended since we last looked, catch up and try again
+		if _, err = w.LastRecord(ctx); err != nil {
+			return 0, err
 		}
 	}
-	if maxOffset == 0 {
-		return Record{}, fmt.Errorf("WAL is empty")
+}
+
+// verifyCopy checks that dst holds the same record at offset as this log
+func (w *S3WAL) verifyCopy(ctx context.Context, dst *S3WAL, offset uint64) error {
+	record, err := w.Read(ctx, offset)
+	if err != nil {
+		return err
 	}
-	w.length = maxOffset
-	return w.Read(ctx, maxOffset)
+	copied, err := dst.Read(ctx, offset)
+	if err != nil {
+		return fmt.Errorf("failed to read offset %d from destination: %w", offset, err)
+	}
+	if !bytes.Equal(record.Data, copied.Data) {
+		return fmt.Errorf("destination does not match the log at offset %d", offset)
+	}
+	return nil
+}
+
+func isSealMarker(metadata map[string]string) bool {
+	return metadata[sealedMetadataKey] == "true"
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
 }
@@ -1,11 +1,14 @@
 package s3_log
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -282,3 +285,267 @@ func TestLastRecord(t *testing.T) {
 		t.Errorf("data mismatch: expected %q, got %q", lastData, record.Data)
 	}
 }
+
+func TestSeal(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("the last of the day")
+	if _, err := wal.Append(ctx, data); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	successor := wal.prefix + "-next"
+	sealOffset, err := wal.Seal(ctx, successor)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if sealOffset != 2 {
+		t.Errorf("expected seal offset 2, got %d", sealOffset)
+	}
+
+	if _, err = wal.Append(ctx, data); !errors.Is(err, ErrSealed) {
+		t.Errorf("expected ErrSealed when appending to sealed WAL, got %v", err)
+	}
+	if _, err = wal.Read(ctx, sealOffset); !errors.Is(err, ErrSealed) {
+		t.Errorf("expected ErrSealed when reading seal marker, got %v", err)
+	}
+
+	// a fresh writer must learn about the seal from the log itself
+	reopened := NewS3WAL(wal.client, wal.bucketName, wal.prefix)
+	record, err := reopened.LastRecord(ctx)
+	if err != nil {
+		t.Fatalf("failed to get last record: %v", err)
+	}
+	if record.Offset != 1 || string(record.Data) != string(data) {
+		t.Errorf("expected last record at offset 1 with %q, got %d with %q", data, record.Offset, record.Data)
+	}
+	if _, err = reopened.Append(ctx, data); !errors.Is(err, ErrSealed) {
+		t.Errorf("expected ErrSealed when appending to reopened WAL, got %v", err)
+	}
+
+	next, err := reopened.Successor(ctx)
+	if err != nil {
+		t.Fatalf("failed to get successor: %v", err)
+	}
+	if next == nil || next.prefix != successor {
+		t.Fatalf("expected successor %q, got %v", successor, next)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src, cleanupSrc := getWAL(t)
+	defer cleanupSrc()
+	dst, cleanupDst := getWAL(t)
+	defer cleanupDst()
+	ctx := context.Background()
+
+	var testData [][]byte
+	for i := 0; i < 25; i++ {
+		data := []byte(generateRandomStr())
+		if _, err := src.AppendWithMetadata(ctx, data, map[string]string{"index": strconv.Itoa(i + 1)}); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		testData = append(testData, data)
+	}
+
+	// another writer keeps appending to the source while we migrate
+	writer := NewS3WAL(src.client, src.bucketName, src.prefix)
+	if _, err := writer.LastRecord(ctx); err != nil {
+		t.Fatalf("failed to get last record: %v", err)
+	}
+	data := []byte("appended during migration")
+	if _, err := writer.Append(ctx, data); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	testData = append(testData, data)
+
+	sealOffset, err := src.Migrate(ctx, dst)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if sealOffset != uint64(len(testData))+1 {
+		t.Errorf("expected seal offset %d, got %d", len(testData)+1, sealOffset)
+	}
+	if _, err = writer.Append(ctx, data); err == nil {
+		t.Error("expected old writer to be fenced off, got nil")
+	}
+
+	next, err := src.Successor(ctx)
+	if err != nil {
+		t.Fatalf("failed to get successor: %v", err)
+	}
+	if next == nil || next.bucketName != dst.bucketName || next.prefix != dst.prefix {
+		t.Fatalf("expected successor %s/%s, got %v", dst.bucketName, dst.prefix, next)
+	}
+	for i, data := range testData {
+		record, err := next.Read(ctx, uint64(i+1))
+		if err != nil {
+			t.Fatalf("failed to read offset %d from destination: %v", i+1, err)
+		}
+		if string(record.Data) != string(data) {
+			t.Errorf("data mismatch at offset %d: expected %q, got %q", i+1, data, record.Data)
+		}
+	}
+	info, err := next.HeadRecord(ctx, 7)
+	if err != nil {
+		t.Fatalf("failed to head offset 7 of destination: %v", err)
+	}
+	if info.Metadata["index"] != "7" {
+		t.Errorf("expected metadata to be copied, got %v", info.Metadata)
+	}
+
+	offset, err := dst.Append(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to append to destination: %v", err)
+	}
+	if offset != sealOffset {
+		t.Errorf("expected destination to continue at offset %d, got %d", sealOffset, offset)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	src, cleanupSrc := getWAL(t)
+	defer cleanupSrc()
+	dst, cleanupDst := getWAL(t)
+	defer cleanupDst()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := src.Append(ctx, []byte(fmt.Sprintf("record-%d", i+1))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	// an earlier migration copied the first 3 records before it died
+	for i := 0; i < 3; i++ {
+		if _, err := dst.Append(ctx, []byte(fmt.Sprintf("record-%d", i+1))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	resumed := NewS3WAL(dst.client, dst.bucketName, dst.prefix)
+	sealOffset, err := src.Migrate(ctx, resumed)
+	if err != nil {
+		t.Fatalf("failed to resume migration: %v", err)
+	}
+	if sealOffset != 6 {
+		t.Errorf("expected seal offset 6, got %d", sealOffset)
+	}
+	record, err := resumed.Read(ctx, 5)
+	if err != nil || string(record.Data) != "record-5" {
+		t.Errorf("expected record-5 at offset 5 of destination, got %q, %v", record.Data, err)
+	}
+
+	// a destination that does not hold a prefix of the log is refused
+	other, cleanupOther := getWAL(t)
+	defer cleanupOther()
+	diverged, cleanupDiverged := getWAL(t)
+	defer cleanupDiverged()
+	for _, data := range []string{"a", "b"} {
+		if _, err = other.Append(ctx, []byte(data)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	if _, err = diverged.Append(ctx, []byte("x")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	fresh := NewS3WAL(diverged.client, diverged.bucketName, diverged.prefix)
+	if _, err = other.Migrate(ctx, fresh); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a mismatch error, got %v", err)
+	}
+}
+
+func FuzzDecodeBody(f *testing.F) {
+	for i, data := range [][]byte{nil, []byte("hello world"), make([]byte, 1024)} {
+		body, err := prepareBody(uint64(i+1), data)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(uint64(i+1), body)
+	}
+	f.Fuzz(func(t *testing.T, offset uint64, body []byte) {
+		record, err := decodeBody(offset, body)
+		if err != nil {
+			return
+		}
+		if record.Offset != offset {
+			t.Fatalf("offset mismatch: expected %d, got %d", offset, record.Offset)
+		}
+		// whatever decodes must be exactly what prepareBody would have written
+		encoded, err := prepareBody(offset, record.Data)
+		if err != nil {
+			t.Fatalf("failed to prepare body: %v", err)
+		}
+		if !bytes.Equal(encoded, body) {
+			t.Fatalf("decoded body does not round trip")
+		}
+	})
+}
+
+func FuzzGetOffsetFromKey(f *testing.F) {
+	f.Add("log", "log/00000000000000000001")
+	f.Add("log", "log/")
+	f.Add("log", "lo")
+	f.Add("", "/18446744073709551615")
+	f.Add("a/b", "a/b/-1")
+	f.Fuzz(func(t *testing.T, prefix, key string) {
+		w := &S3WAL{prefix: prefix}
+		offset, err := w.getOffsetFromKey(key)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(key, prefix+"/") {
+			t.Fatalf("parsed offset %d from key %q outside of prefix %q", offset, key, prefix)
+		}
+		if len(key) == len(prefix)+21 && w.getObjectKey(offset) != key {
+			t.Fatalf("key %q does not round trip, got %q", key, w.getObjectKey(offset))
+		}
+	})
+}
+
+func TestAppendIfTail(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	offset, err := wal.AppendIfTail(ctx, 0, []byte("first"))
+	if err != nil {
+		t.Fatalf("failed to append to empty WAL: %v", err)
+	}
+	if offset != 1 {
+		t.Errorf("expected offset 1, got %d", offset)
+	}
+
+	other := NewS3WAL(wal.client, wal.bucketName, wal.prefix)
+	if _, err = other.AppendIfTail(ctx, 1, []byte("second")); err != nil {
+		t.Fatalf("failed to append at tail seen by another writer: %v", err)
+	}
+
+	// stale expectation: the log ends at 2 now
+	actual, err := wal.AppendIfTail(ctx, 1, []byte("stale"))
+	if !errors.Is(err, ErrOffsetConflict) {
+		t.Fatalf("expected ErrOffsetConflict, got %v", err)
+	}
+	if actual != 2 {
+		t.Errorf("expected actual tail 2, got %d", actual)
+	}
+	if wal.length != 1 {
+		t.Errorf("expected length to stay at 1 after conflict, got %d", wal.length)
+	}
+
+	// expecting a tail beyond the end must not leave a gap
+	actual, err = wal.AppendIfTail(ctx, 5, []byte("gap"))
+	if !errors.Is(err, ErrOffsetConflict) {
+		t.Fatalf("expected ErrOffsetConflict for missing tail, got %v", err)
+	}
+	if actual != 2 {
+		t.Errorf("expected actual tail 2, got %d", actual)
+	}
+
+	if offset, err = wal.AppendIfTail(ctx, actual, []byte("third")); err != nil {
+		t.Fatalf("failed to append after retry: %v", err)
+	}
+	if offset != 3 {
+		t.Errorf("expected offset 3, got %d", offset)
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// forwardedHeader marks an append forwarded by another server, which must
+// not be forwarded again
+const forwardedHeader = "S3log-Forwarded"
+
+// Log is a log served by a Server. It implements s3_log.WAL, so connectors
+// in the same process can append through it too. Appends are serialized on
+// one S3WAL, as an S3WAL must only be used by one writer at a time, while
+// reads go to a second one and so never move the position of the writer.
+//
+// Several servers can serve the same log if they share a lease, see
+// UseLease. Only the owner of the lease appends, the others forward their
+// appends to it over HTTP and serve reads straight from S3.
+type Log struct {
+	name   string
+	reader *s3_log.S3WAL
+	lease  *s3_log.Lease
+	client *http.Client
+
+	mu     sync.Mutex
+	writer *s3_log.S3WAL
+	// tailKnown is whether the writer has found the end of the log in
+	// tailEpoch of the lease, and not failed to append since
+	tailKnown bool
+	tailEpoch uint64
+}
+
+// NewLog returns the log clients know as name. reader and writer must be two
+// WALs for the same log.
+func NewLog(name string, reader, writer *s3_log.S3WAL) *Log {
+	return &Log{name: name, reader: reader, writer: writer, client: &http.Client{Timeout: time.Minute}}
+}
+
+// UseLease makes the owner of lease the only server that appends to the log.
+// The owner of a lease is the base URL the other servers reach its server
+// at, e.g. "http://10.0.0.1:8080", and every server must serve the log under
+// the same name. RunLease keeps the lease.
+func (l *Log) UseLease(lease *s3_log.Lease) {
+	l.lease = lease
+	l.writer.UseLease(lease)
+}
+
+func (l *Log) Name() string {
+	return l.name
+}
+
+// Append appends data itself if this server owns the log, and otherwise
+// forwards it to the owner. If the lease is free it takes the lease first.
+func (l *Log) Append(ctx context.Context, data []byte) (uint64, error) {
+	if l.lease != nil && !l.lease.Held() {
+		owner, _, err := l.lease.Leader(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if owner != "" && owner != l.lease.Owner() {
+			return l.forward(ctx, owner, data)
+		}
+		if err = l.lease.Acquire(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return l.appendOwned(ctx, data)
+}
+
+// appendOwned appends data if this server owns the log, and fails with
+// s3_log.ErrLeaseLost otherwise
+func (l *Log) appendOwned(ctx context.Context, data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var epoch uint64
+	if l.lease != nil {
+		if !l.lease.Held() {
+			return 0, s3_log.ErrLeaseLost
+		}
+		epoch = l.lease.Epoch()
+	}
+	// after a failover the previous owner has moved the tail, so a new
+	// owner has to find it before appending to keep offsets continuous
+	if !l.tailKnown || l.tailEpoch != epoch {
+		if _, err := l.writer.LastRecord(ctx); err != nil && !errors.Is(err, s3_log.ErrEmpty) {
+			return 0, err
+		}
+		l.tailKnown, l.tailEpoch = true, epoch
+	}
+	offset, err := l.writer.Append(ctx, data)
+	if err != nil {
+		// another writer may have taken the offset, find the tail again
+		l.tailKnown = false
+	}
+	return offset, err
+}
+
+// forward appends data through the server at owner
+func (l *Log) forward(ctx context.Context, owner string, data []byte) (uint64, error) {
+	target := strings.TrimSuffix(owner, "/") + "/logs/" + url.PathEscape(l.name) + "/records"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(forwardedHeader, "1")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, &statusError{
+			status: http.StatusBadGateway,
+			err:    fmt.Errorf("failed to forward append to %s: %w", owner, err),
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, &statusError{
+			status: resp.StatusCode,
+			err:    fmt.Errorf("owner %s failed to append: %s", owner, strings.TrimSpace(string(msg))),
+		}
+	}
+	var result appendResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode response of %s: %w", owner, err)
+	}
+	return result.Offset, nil
+}
+
+// RunLease takes the lease whenever it is free and renews it while held,
+// every interval, which should be well below the ttl of the lease. It
+// releases the lease when ctx is done, so another server can take over
+// right away.
+func (l *Log) RunLease(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		if l.lease.Held() {
+			err = l.lease.Renew(ctx)
+		} else {
+			err = l.lease.Acquire(ctx)
+		}
+		if err != nil && !errors.Is(err, s3_log.ErrLeaseLost) && ctx.Err() == nil {
+			logger.Error("failed to keep lease", "log", l.name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			if err := l.lease.Release(context.Background()); err != nil {
+				logger.Error("failed to release lease", "log", l.name, "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Log) Read(ctx context.Context, offset uint64) (s3_log.Record, error) {
+	return l.reader.Read(ctx, offset)
+}
+
+func (l *Log) ReadWithInfo(ctx context.Context, offset uint64) (s3_log.Record, s3_log.RecordInfo, error) {
+	return l.reader.ReadWithInfo(ctx, offset)
+}
+
+// WaitForOffset blocks until the record at offset is visible to this
+// server, see s3_log.S3WAL.WaitForOffset.
+func (l *Log) WaitForOffset(ctx context.Context, offset uint64) error {
+	return l.reader.WaitForOffset(ctx, offset, sessionPollInterval)
+}
+
+// LastOffset returns the offset of the last record, or 0 if there is none.
+func (l *Log) LastOffset(ctx context.Context) (uint64, error) {
+	return l.reader.LastOffset(ctx)
+}
+
+func (l *Log) LastRecord(ctx context.Context) (s3_log.Record, error) {
+	offset, err := l.LastOffset(ctx)
+	if err != nil {
+		return s3_log.Record{}, err
+	}
+	if offset == 0 {
+		return s3_log.Record{}, s3_log.ErrEmpty
+	}
+	return l.Read(ctx, offset)
+}
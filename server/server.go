@@ -0,0 +1,476 @@
+// Package server serves logs over HTTP:
+//
+//	POST /logs/{log}/records
+//	    appends the body as a record and answers {"offset": n, "session": s}
+//	GET /logs/{log}/records/{offset}?filter=
+//	    the data of the record at offset
+//	GET /logs/{log}/records?cursor=&from=&limit=&filter=
+//	    a page of records from the cursor, or from the offset from if there
+//	    is none, as {"records": [{"offset": n, "data": base64}], "cursor": c}
+//	GET /logs/{log}/tail?cursor=&limit=&wait=&filter=
+//	    like records, but starting at the end of the log and waiting up to
+//	    wait, e.g. "10s", for records to arrive
+//	GET /logs/{log}/arrow?from=&to=&batch_size=
+//	    the records in [from, to] as an Arrow IPC stream, see arrowlog
+//
+// Any server of a log can take any request: appends are forwarded to the
+// owner of the log, see Log.UseLease, and reads are served from S3. Cursors
+// are opaque tokens that hold the whole position, so a client can resume
+// through any server, also after a restart.
+//
+// The session token of an append, also in its S3log-Session header, can be
+// passed to any read in the same header or as the session parameter. The
+// server then waits until it sees the record of the append before answering,
+// so a client reads its own writes through any server.
+//
+// filter is a CEL expression, see celfilter.Filter, and only records that
+// match it are answered. A cursor carries the filter of the read it came
+// from, so the filter can be left out when resuming, but not changed.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/arrowlog"
+	"github.com/avinassh/s3-log/celfilter"
+)
+
+const (
+	// maxRecordSize bounds the body of an append
+	maxRecordSize = 16 << 20
+	// maxArrowBatchSize bounds the rows a client can make us buffer per batch
+	maxArrowBatchSize = 10000
+	// defaultPageSize and maxPageSize are the records in a page of records
+	// or tail by default and at most
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	// maxTailWait bounds how long a tail waits for records
+	maxTailWait = time.Minute
+	// tailPollInterval is how often a waiting tail looks for new records
+	tailPollInterval = 200 * time.Millisecond
+	// filterCacheSize is the number of compiled filters kept around
+	filterCacheSize = 256
+	// sessionHeader carries the session token of an append to later reads
+	sessionHeader = "S3log-Session"
+	// maxSessionWait bounds how long a read waits for the record of its
+	// session, which only takes long if the append is still in flight
+	maxSessionWait = 10 * time.Second
+	// sessionPollInterval is how often a read looks for that record
+	sessionPollInterval = 50 * time.Millisecond
+)
+
+type appendResponse struct {
+	Offset  uint64 `json:"offset"`
+	Session string `json:"session"`
+}
+
+type pageRecord struct {
+	Offset uint64 `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type pageResponse struct {
+	Records []pageRecord `json:"records"`
+	Cursor  string       `json:"cursor"`
+}
+
+// statusError is an error to answer with a given status, such as the one the
+// owner answered a forwarded append with
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+type Server struct {
+	logs    map[string]*Log
+	logger  *slog.Logger
+	mux     *http.ServeMux
+	filters *celfilter.Cache
+}
+
+func New(logs map[string]*Log, logger *slog.Logger) *Server {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Server{
+		logs:    logs,
+		logger:  logger,
+		mux:     http.NewServeMux(),
+		filters: celfilter.NewCache(filterCacheSize, celfilter.DefaultCostLimit),
+	}
+	s.mux.HandleFunc("POST /logs/{log}/records", s.handleAppend)
+	s.mux.HandleFunc("GET /logs/{log}/records/{offset}", s.handleRead)
+	s.mux.HandleFunc("GET /logs/{log}/records", s.handleRecords)
+	s.mux.HandleFunc("GET /logs/{log}/tail", s.handleTail)
+	s.mux.HandleFunc("GET /logs/{log}/arrow", s.handleArrow)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// log returns the log named in the path, or answers 404
+func (s *Server) log(w http.ResponseWriter, r *http.Request) (*Log, bool) {
+	name := r.PathValue("log")
+	l, ok := s.logs[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no log named %q", name), http.StatusNotFound)
+	}
+	return l, ok
+}
+
+// uintParam returns the query parameter name, or def if it is not set
+func uintParam(r *http.Request, name string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// waitForSession waits until l has the record of the session token of r, if
+// it has one, or answers with an error
+func waitForSession(w http.ResponseWriter, r *http.Request, l *Log) bool {
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		token = r.URL.Query().Get("session")
+	}
+	if token == "" {
+		return true
+	}
+	offset, err := s3_log.DecodeSessionToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), maxSessionWait)
+	defer cancel()
+	err = l.WaitForOffset(ctx, offset)
+	if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+		err = &statusError{
+			status: http.StatusServiceUnavailable,
+			err:    fmt.Errorf("offset %d of the session is not visible yet", offset),
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return false
+	}
+	return true
+}
+
+// pageParams returns the cursor and limit of a records or tail request. The
+// cursor is nil if the request has none, and a filter in the request must be
+// the one of the cursor.
+func pageParams(r *http.Request, l *Log) (*s3_log.Cursor, int, error) {
+	limit, err := uintParam(r, "limit", defaultPageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit == 0 || limit > maxPageSize {
+		return nil, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	token := r.URL.Query().Get("cursor")
+	if token == "" {
+		return nil, int(limit), nil
+	}
+	cursor, err := s3_log.DecodeCursor(token, l.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.URL.Query().Has("filter") && r.URL.Query().Get("filter") != cursor.Filter {
+		return nil, 0, fmt.Errorf("filter differs from the one of the cursor %q", cursor.Filter)
+	}
+	return &cursor, int(limit), nil
+}
+
+// matcher returns a match function for ReadPage that keeps the records
+// matching the filter expr, or nil for an empty expr
+func (s *Server) matcher(expr string) (func(s3_log.Record) (bool, error), error) {
+	if expr == "" {
+		return nil, nil
+	}
+	f, err := s.filters.Get(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(record s3_log.Record) (bool, error) {
+		ok, err := f.Match(record)
+		if err != nil {
+			// e.g. a conversion that fails on the payload, which is down to
+			// the expression
+			return false, &statusError{status: http.StatusBadRequest, err: err}
+		}
+		return ok, nil
+	}, nil
+}
+
+// errorStatus returns the status to answer a failed request with
+func errorStatus(err error) int {
+	var se *statusError
+	var nsk *types.NoSuchKey
+	switch {
+	case errors.As(err, &se):
+		return se.status
+	case errors.Is(err, s3_log.ErrLeaseLost):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, s3_log.ErrSealed):
+		return http.StatusConflict
+	case errors.As(err, &nsk):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleAppend(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.log(w, r)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var offset uint64
+	if r.Header.Get(forwardedHeader) != "" {
+		// the sender took us for the owner, which we may no longer be, and
+		// forwarding again could go around in circles
+		offset, err = l.appendOwned(r.Context(), data)
+	} else {
+		offset, err = l.Append(r.Context(), data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	session := s3_log.EncodeSessionToken(offset)
+	w.Header().Set(sessionHeader, session)
+	writeJSON(w, appendResponse{Offset: offset, Session: session})
+}
+
+func (s *Server) handleRead(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.log(w, r)
+	if !ok || !waitForSession(w, r, l) {
+		return
+	}
+	offset, err := strconv.ParseUint(r.PathValue("offset"), 10, 64)
+	if err != nil || offset == 0 {
+		http.Error(w, fmt.Sprintf("invalid offset %q", r.PathValue("offset")), http.StatusBadRequest)
+		return
+	}
+	match, err := s.matcher(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	record, err := l.Read(r.Context(), offset)
+	if errors.Is(err, s3_log.ErrSealed) {
+		// the seal marker is past the last record
+		err = &statusError{status: http.StatusNotFound, err: err}
+	}
+	if err == nil && match != nil {
+		var ok bool
+		if ok, err = match(record); err == nil && !ok {
+			err = &statusError{status: http.StatusNotFound, err: fmt.Errorf("record %d does not match the filter", offset)}
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(record.Data)
+}
+
+func (s *Server) handleRecords(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.log(w, r)
+	if !ok || !waitForSession(w, r, l) {
+		return
+	}
+	cursor, limit, err := pageParams(r, l)
+	var from uint64
+	if err == nil {
+		from, err = uintParam(r, "from", 1)
+	}
+	if err == nil && cursor != nil && r.URL.Query().Has("from") {
+		err = fmt.Errorf("from and cursor are mutually exclusive")
+	}
+	if cursor == nil {
+		cursor = &s3_log.Cursor{Log: l.Name(), Offset: from, Filter: r.URL.Query().Get("filter")}
+	}
+	var match func(s3_log.Record) (bool, error)
+	if err == nil {
+		match, err = s.matcher(cursor.Filter)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, next, err := s3_log.ReadPage(r.Context(), l, *cursor, limit, match)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writePage(w, records, next)
+}
+
+func (s *Server) handleTail(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.log(w, r)
+	if !ok || !waitForSession(w, r, l) {
+		return
+	}
+	cursor, limit, err := pageParams(r, l)
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); err == nil && v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 || wait > maxTailWait {
+			err = fmt.Errorf("wait must be a duration between 0 and %v", maxTailWait)
+		}
+	}
+	filter := r.URL.Query().Get("filter")
+	if cursor != nil {
+		filter = cursor.Filter
+	}
+	var match func(s3_log.Record) (bool, error)
+	if err == nil {
+		match, err = s.matcher(filter)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cursor == nil {
+		last, err := l.LastOffset(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		cursor = &s3_log.Cursor{Log: l.Name(), Offset: last + 1, Filter: filter}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		records, next, err := s3_log.ReadPage(r.Context(), l, *cursor, limit, match)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if len(records) > 0 || !time.Now().Before(deadline) {
+			writePage(w, records, next)
+			return
+		}
+		*cursor = next
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(tailPollInterval):
+		}
+	}
+}
+
+func writePage(w http.ResponseWriter, records []s3_log.Record, next s3_log.Cursor) {
+	resp := pageResponse{Records: make([]pageRecord, len(records)), Cursor: next.Encode()}
+	for i, record := range records {
+		resp.Records[i] = pageRecord{Offset: record.Offset, Data: record.Data}
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleArrow(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.log(w, r)
+	if !ok || !waitForSession(w, r, l) {
+		return
+	}
+	from, err := uintParam(r, "from", 1)
+	if err == nil && from == 0 {
+		err = fmt.Errorf("from must be at least 1")
+	}
+	var to, batchSize uint64
+	if err == nil {
+		to, err = uintParam(r, "to", 0)
+	}
+	if err == nil {
+		batchSize, err = uintParam(r, "batch_size", 0)
+	}
+	if err == nil && batchSize > maxArrowBatchSize {
+		err = fmt.Errorf("batch_size is over the limit of %d", maxArrowBatchSize)
+	}
+	if err == nil && to != 0 && from > to {
+		err = fmt.Errorf("from %d is after to %d", from, to)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to == 0 {
+		// up to the end of the log, which may be before from
+		if to, err = l.LastOffset(r.Context()); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.arrow.stream")
+	tw := &trackingWriter{w: w}
+	if from > to {
+		// an empty stream, with just the schema
+		err = ipc.NewWriter(tw, ipc.WithSchema(arrowlog.Schema)).Close()
+	} else {
+		err = arrowlog.NewReader(l, int(batchSize)).WriteIPCStream(r.Context(), tw, from, to)
+	}
+	if err != nil {
+		if !tw.wrote {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// too late for a status, the client sees a truncated stream
+		s.logger.Error("arrow stream failed", "log", l.Name(), "error", err)
+	}
+}
+
+// trackingWriter records whether anything was written, after which the
+// status can no longer be changed
+type trackingWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.w.Write(p)
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/s3test"
+)
+
+// newTestLog returns a log named "test" in a fresh bucket
+func newTestLog(t *testing.T) *Log {
+	client := s3test.Client()
+	bucketName := s3test.Bucket(t, client)
+	prefix := s3test.RandomStr()
+	return NewLog("test", s3_log.NewS3WAL(client, bucketName, prefix), s3_log.NewS3WAL(client, bucketName, prefix))
+}
+
+func startServer(t *testing.T, logs ...*Log) *httptest.Server {
+	byName := make(map[string]*Log, len(logs))
+	for _, l := range logs {
+		byName[l.Name()] = l
+	}
+	server := httptest.NewServer(New(byName, nil))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startCluster starts two servers of the same log, whose leases are owned
+// under the URLs of the servers
+func startCluster(t *testing.T) ([]*Log, []*httptest.Server) {
+	client := s3test.Client()
+	bucketName := s3test.Bucket(t, client)
+	prefix := s3test.RandomStr()
+	var logs []*Log
+	var servers []*httptest.Server
+	for range 2 {
+		server := httptest.NewServer(nil)
+		t.Cleanup(server.Close)
+		log := NewLog("test", s3_log.NewS3WAL(client, bucketName, prefix), s3_log.NewS3WAL(client, bucketName, prefix))
+		log.UseLease(s3_log.NewLease(client, bucketName, prefix, server.URL, 10*time.Second))
+		server.Config.Handler = New(map[string]*Log{"test": log}, nil)
+		logs = append(logs, log)
+		servers = append(servers, server)
+	}
+	return logs, servers
+}
+
+// postRecord appends data through the server at url
+func postRecord(t *testing.T, url string, data string) appendResponse {
+	t.Helper()
+	resp, err := http.Post(url+"/logs/test/records", "application/octet-stream", strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("failed to append: %s: %s", resp.Status, msg)
+	}
+	var result appendResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// getRecord returns the data of the record at offset through the server at
+// url, along with the status
+func getRecord(t *testing.T, url string, offset uint64) (string, int) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("%s/logs/test/records/%d", url, offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), resp.StatusCode
+}
+
+func TestForwardToOwner(t *testing.T) {
+	logs, servers := startCluster(t)
+	owner, follower := logs[0], logs[1]
+	ctx := context.Background()
+	if err := owner.lease.Acquire(ctx); err != nil {
+		t.Fatalf("failed to acquire lease: %v", err)
+	}
+
+	// appends through the follower, over HTTP or from a connector in its
+	// process, are made by the owner
+	if result := postRecord(t, servers[1].URL, "a"); result.Offset != 1 {
+		t.Errorf("expected offset 1, got %d", result.Offset)
+	}
+	if offset, err := follower.Append(ctx, []byte("b")); err != nil || offset != 2 {
+		t.Errorf("expected offset 2, got %d, %v", offset, err)
+	}
+	if offset, err := owner.Append(ctx, []byte("c")); err != nil || offset != 3 {
+		t.Errorf("expected offset 3, got %d, %v", offset, err)
+	}
+	if follower.lease.Held() {
+		t.Error("expected the follower not to hold the lease")
+	}
+	// the follower serves reads itself
+	if data, status := getRecord(t, servers[1].URL, 2); status != http.StatusOK || data != "b" {
+		t.Errorf("expected b from the follower, got %s: %q", http.StatusText(status), data)
+	}
+	if _, status := getRecord(t, servers[1].URL, 4); status != http.StatusNotFound {
+		t.Errorf("expected 404 past the end, got %s", http.StatusText(status))
+	}
+
+	// an append forwarded to a server that is not the owner is not
+	// forwarded again
+	req, _ := http.NewRequest(http.MethodPost, servers[1].URL+"/logs/test/records", strings.NewReader("x"))
+	req.Header.Set(forwardedHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a forwarded append to a follower, got %s", resp.Status)
+	}
+
+	// the owner goes away and the follower carries on after its last record
+	if err = owner.lease.Release(ctx); err != nil {
+		t.Fatalf("failed to release lease: %v", err)
+	}
+	if offset, err := follower.Append(ctx, []byte("d")); err != nil || offset != 4 {
+		t.Errorf("expected offset 4 after failover, got %d, %v", offset, err)
+	}
+	if result := postRecord(t, servers[0].URL, "e"); result.Offset != 5 {
+		t.Errorf("expected offset 5 through the old owner, got %d", result.Offset)
+	}
+	if owner.lease.Held() || !follower.lease.Held() {
+		t.Error("expected the follower to own the log")
+	}
+	for offset, want := range []string{"a", "b", "c", "d", "e"} {
+		if data, status := getRecord(t, servers[0].URL, uint64(offset+1)); status != http.StatusOK || data != want {
+			t.Errorf("expected %q at %d, got %s: %q", want, offset+1, http.StatusText(status), data)
+		}
+	}
+
+	// RunLease gives the lease up when it stops
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		follower.RunLease(runCtx, 10*time.Millisecond, slog.Default())
+		close(done)
+	}()
+	cancel()
+	<-done
+	if leader, _, err := owner.lease.Leader(ctx); err != nil || leader != "" {
+		t.Errorf("expected the lease to be free, got %q, %v", leader, err)
+	}
+}
+
+// getPage GETs path from the server at url and decodes the page it answers
+func getPage(t *testing.T, url, path string) pageResponse {
+	t.Helper()
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("failed to get %s: %s: %s", path, resp.Status, msg)
+	}
+	var page pageResponse
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+// pageData returns the data of the records in page
+func pageData(page pageResponse) []string {
+	var data []string
+	for _, record := range page.Records {
+		data = append(data, string(record.Data))
+	}
+	return data
+}
+
+func TestSessionReadsOwnWrites(t *testing.T) {
+	logs, servers := startCluster(t)
+	if err := logs[0].lease.Acquire(context.Background()); err != nil {
+		t.Fatalf("failed to acquire lease: %v", err)
+	}
+	// appending through the follower still hands out a session
+	result := postRecord(t, servers[1].URL, "a")
+	if offset, err := s3_log.DecodeSessionToken(result.Session); err != nil || offset != result.Offset {
+		t.Fatalf("expected a session at offset %d, got %d, %v", result.Offset, offset, err)
+	}
+
+	// a read with the session of an append still in flight waits for it
+	session := s3_log.EncodeSessionToken(2)
+	type response struct {
+		data   string
+		status int
+	}
+	responses := make(chan response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, servers[1].URL+"/logs/test/records/2", nil)
+		req.Header.Set(sessionHeader, session)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			responses <- response{data: err.Error()}
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		responses <- response{string(data), resp.StatusCode}
+	}()
+	time.Sleep(5 * sessionPollInterval)
+	if result = postRecord(t, servers[0].URL, "b"); result.Session != session {
+		t.Errorf("expected session %s, got %s", session, result.Session)
+	}
+	select {
+	case resp := <-responses:
+		if resp.status != http.StatusOK || resp.data != "b" {
+			t.Errorf("expected b for the session, got %s: %q", http.StatusText(resp.status), resp.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read with the session did not return")
+	}
+
+	// pages, tails and arrow streams take the session too
+	page := getPage(t, servers[1].URL, "/logs/test/records?from=2&session="+session)
+	if data := pageData(page); !reflect.DeepEqual(data, []string{"b"}) {
+		t.Errorf("expected [b] with the session, got %v", data)
+	}
+	for _, path := range []string{"/logs/test/tail?session=", "/logs/test/arrow?session="} {
+		resp, err := http.Get(servers[1].URL + path + session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200 with the session, got %s", path, resp.Status)
+		}
+		if resp, err = http.Get(servers[1].URL + path + "garbage"); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 for an invalid session, got %s", path, resp.Status)
+		}
+	}
+}
+
+func TestRecordPages(t *testing.T) {
+	l := newTestLog(t)
+	server := startServer(t, l)
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		postRecord(t, server.URL, data)
+	}
+
+	page := getPage(t, server.URL, "/logs/test/records?limit=2")
+	var got []string
+	for len(page.Records) > 0 {
+		got = append(got, pageData(page)...)
+		page = getPage(t, server.URL, "/logs/test/records?limit=2&cursor="+page.Cursor)
+	}
+	if !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("expected all records across pages, got %v", got)
+	}
+
+	// the last cursor picks up records appended later, also through another
+	// server, as it holds the whole position
+	postRecord(t, server.URL, "f")
+	restarted := startServer(t, l)
+	if data := pageData(getPage(t, restarted.URL, "/logs/test/records?cursor="+page.Cursor)); !reflect.DeepEqual(data, []string{"f"}) {
+		t.Errorf("expected [f] after the last cursor, got %v", data)
+	}
+	if data := pageData(getPage(t, server.URL, "/logs/test/records?from=5&limit=1")); !reflect.DeepEqual(data, []string{"e"}) {
+		t.Errorf("expected [e] from 5, got %v", data)
+	}
+
+	other := s3_log.Cursor{Log: "other", Offset: 1}.Encode()
+	for _, query := range []string{"cursor=garbage", "cursor=" + other, "limit=0", "limit=1001", "from=1&cursor=" + page.Cursor} {
+		resp, err := http.Get(server.URL + "/logs/test/records?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %s", query, resp.Status)
+		}
+	}
+}
+
+func TestTail(t *testing.T) {
+	l := newTestLog(t)
+	server := startServer(t, l)
+	postRecord(t, server.URL, "old")
+
+	// without a cursor the tail starts at the end, and without wait it
+	// answers right away
+	page := getPage(t, server.URL, "/logs/test/tail")
+	if len(page.Records) != 0 {
+		t.Errorf("expected no records at the end, got %v", pageData(page))
+	}
+
+	pages := make(chan pageResponse)
+	go func() {
+		resp, err := http.Get(server.URL + "/logs/test/tail?wait=10s&cursor=" + page.Cursor)
+		if err != nil {
+			close(pages)
+			return
+		}
+		defer resp.Body.Close()
+		var next pageResponse
+		json.NewDecoder(resp.Body).Decode(&next)
+		pages <- next
+	}()
+	time.Sleep(2 * tailPollInterval)
+	postRecord(t, server.URL, "new")
+	select {
+	case next := <-pages:
+		if data := pageData(next); !reflect.DeepEqual(data, []string{"new"}) {
+			t.Errorf("expected [new] from the waiting tail, got %v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tail did not return the new record")
+	}
+
+	resp, err := http.Get(server.URL + "/logs/test/tail?wait=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a wait over the limit, got %s", resp.Status)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	l := newTestLog(t)
+	server := startServer(t, l)
+	for _, data := range []string{`{"level":"info"}`, `{"level":"error","n":1}`, `not json`, `{"level":"error","n":2}`, `{"n":3}`} {
+		postRecord(t, server.URL, data)
+	}
+	filter := url.QueryEscape(`json.level == "error"`)
+
+	page := getPage(t, server.URL, "/logs/test/records?limit=1&filter="+filter)
+	got := pageData(page)
+	// resuming without the filter keeps the one of the cursor
+	page = getPage(t, server.URL, "/logs/test/records?cursor="+page.Cursor)
+	got = append(got, pageData(page)...)
+	if !reflect.DeepEqual(got, []string{`{"level":"error","n":1}`, `{"level":"error","n":2}`}) {
+		t.Errorf("expected the errors, got %v", got)
+	}
+
+	if data, status := getRecord(t, server.URL, 2); status != http.StatusOK || data != `{"level":"error","n":1}` {
+		t.Errorf("expected record 2, got %s: %q", http.StatusText(status), data)
+	}
+	resp, err := http.Get(server.URL + "/logs/test/records/1?filter=" + filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a record that does not match, got %s", resp.Status)
+	}
+
+	// the tail skips records that do not match
+	postRecord(t, server.URL, `{"level":"info"}`)
+	postRecord(t, server.URL, `{"level":"error","n":4}`)
+	page = getPage(t, server.URL, "/logs/test/tail?wait=5s&cursor="+page.Cursor)
+	if data := pageData(page); !reflect.DeepEqual(data, []string{`{"level":"error","n":4}`}) {
+		t.Errorf("expected the new error from the tail, got %v", data)
+	}
+
+	for _, path := range []string{
+		"/logs/test/records?filter=" + url.QueryEscape(`json.level ==`),
+		"/logs/test/records?filter=" + url.QueryEscape(`json.level`),
+		"/logs/test/records?filter=" + url.QueryEscape(`int(json.level) > 0`),
+		"/logs/test/records?filter=" + url.QueryEscape(`offset > 1`) + "&cursor=" + page.Cursor,
+		"/logs/test/tail?filter=" + url.QueryEscape(`offset > 1`) + "&cursor=" + page.Cursor,
+		"/logs/test/records/1?filter=" + url.QueryEscape(`json.level ==`),
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %s", path, resp.Status)
+		}
+	}
+}
+
+func TestArrowStream(t *testing.T) {
+	log := newTestLog(t)
+	server := startServer(t, log)
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		if _, err := log.Append(ctx, []byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	// readOffsets returns the offsets in the stream and the number of batches
+	readOffsets := func(query string) ([]uint64, int) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/logs/test/arrow" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %s", query, resp.Status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.apache.arrow.stream" {
+			t.Errorf("%s: unexpected content type %q", query, ct)
+		}
+		reader, err := ipc.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: failed to open IPC stream: %v", query, err)
+		}
+		defer reader.Release()
+		var offsets []uint64
+		batches := 0
+		for reader.Next() {
+			batches++
+			column := reader.Record().Column(0).(*array.Uint64)
+			for i := 0; i < column.Len(); i++ {
+				offsets = append(offsets, column.Value(i))
+			}
+		}
+		if err := reader.Err(); err != nil {
+			t.Fatalf("%s: failed to read IPC stream: %v", query, err)
+		}
+		return offsets, batches
+	}
+
+	if offsets, batches := readOffsets("?from=2&batch_size=2"); fmt.Sprint(offsets) != "[2 3 4 5]" || batches != 2 {
+		t.Errorf("expected offsets [2 3 4 5] in 2 batches, got %v in %d", offsets, batches)
+	}
+	if offsets, _ := readOffsets("?from=2&to=3"); fmt.Sprint(offsets) != "[2 3]" {
+		t.Errorf("expected offsets [2 3], got %v", offsets)
+	}
+	// past the end of the log the stream is empty
+	if offsets, batches := readOffsets("?from=6"); len(offsets) != 0 || batches != 0 {
+		t.Errorf("expected an empty stream, got %v in %d batches", offsets, batches)
+	}
+
+	for query, status := range map[string]int{
+		"/logs/test/arrow?from=0":              http.StatusBadRequest,
+		"/logs/test/arrow?from=3&to=2":         http.StatusBadRequest,
+		"/logs/test/arrow?batch_size=x":        http.StatusBadRequest,
+		"/logs/test/arrow?batch_size=10000000": http.StatusBadRequest,
+		"/logs/missing/arrow":                  http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected %d, got %s", query, status, resp.Status)
+		}
+	}
+}
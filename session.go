@@ -0,0 +1,76 @@
+package s3_log
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const sessionTokenVersion = 1
+
+var ErrInvalidSessionToken = errors.New("invalid session token")
+
+// EncodeSessionToken returns an opaque token for the last offset a client
+// got acknowledged. Servers hand it out with every append and take it back on
+// reads, so that a client sees its own writes whichever replica it talks to.
+func EncodeSessionToken(offset uint64) string {
+	buf := make([]byte, 9)
+	buf[0] = sessionTokenVersion
+	binary.BigEndian.PutUint64(buf[1:], offset)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func DecodeSessionToken(token string) (uint64, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != 9 || buf[0] != sessionTokenVersion {
+		return 0, ErrInvalidSessionToken
+	}
+	return binary.BigEndian.Uint64(buf[1:]), nil
+}
+
+// WaitForOffset blocks until this replica has observed offset, polling S3
+// every interval. S3 is strongly consistent, so an acknowledged append is
+// visible right away and this only waits when the token is from an append
+// that is still in flight. It is safe to call from many goroutines at once,
+// also while another one appends.
+func (w *S3WAL) WaitForOffset(ctx context.Context, offset uint64, interval time.Duration) error {
+	for w.observed.Load() < offset {
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(w.bucketName),
+			Key:    aws.String(w.getObjectKey(offset)),
+		}
+		_, err := w.client.HeadObject(ctx, input)
+		if err == nil {
+			// offsets are contiguous, so everything before it exists too
+			w.observe(offset)
+			return nil
+		}
+		var nf *types.NotFound
+		if !errors.As(err, &nf) {
+			return fmt.Errorf("failed to head object from S3: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return nil
+}
+
+// observe raises the highest offset known to exist to offset
+func (w *S3WAL) observe(offset uint64) {
+	for {
+		current := w.observed.Load()
+		if current >= offset || w.observed.CompareAndSwap(current, offset) {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package s3_log
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	token := EncodeSessionToken(1234)
+	offset, err := DecodeSessionToken(token)
+	if err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	if offset != 1234 {
+		t.Errorf("expected offset 1234, got %d", offset)
+	}
+	if _, err = DecodeSessionToken("not a token"); !errors.Is(err, ErrInvalidSessionToken) {
+		t.Errorf("expected ErrInvalidSessionToken, got %v", err)
+	}
+}
+
+func TestWaitForOffset(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	replica := NewS3WAL(wal.client, wal.bucketName, wal.prefix)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		wal.Append(ctx, []byte("written elsewhere"))
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := replica.WaitForOffset(waitCtx, 1, 20*time.Millisecond); err != nil {
+		t.Fatalf("failed to wait for offset: %v", err)
+	}
+	record, err := replica.Read(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(record.Data) != "written elsewhere" {
+		t.Errorf("data mismatch: got %q", record.Data)
+	}
+
+	waitCtx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err = replica.WaitForOffset(waitCtx, 2, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded for missing offset, got %v", err)
+	}
+}
+
+func TestWaitForOffsetConcurrent(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// readers wait on the same WAL that is appending, as on a server replica
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(offset uint64) {
+			defer wg.Done()
+			errs <- wal.WaitForOffset(ctx, offset, 10*time.Millisecond)
+		}(uint64(i%3 + 1))
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append(ctx, []byte("record")); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("failed to wait for offset: %v", err)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var (
+	ErrNoSnapshot     = errors.New("no snapshot")
+	ErrSnapshotExists = errors.New("snapshot already exists")
+)
+
+// Manifest describes a snapshot of the state built from a log up to Offset.
+// The state is split into chunks of ChunkSize bytes, the last one possibly
+// shorter, which are stored by the sha256 of their content.
+type Manifest struct {
+	Offset    uint64    `json:"offset"`
+	Size      int64     `json:"size"`
+	ChunkSize int       `json:"chunk_size"`
+	Chunks    []string  `json:"chunks"`
+	Created   time.Time `json:"created"`
+}
+
+// Stats tells how much of a snapshot had to be uploaded.
+type Stats struct {
+	Chunks   int
+	Reused   int
+	Uploaded int64
+}
+
+// Store keeps incremental snapshots in S3:
+//
+//	prefix/chunks/<sha256>       content of a chunk
+//	prefix/snapshots/<offset>    manifest of a snapshot, as JSON
+//
+// Chunks are content addressed, so a chunk that did not change since the
+// previous snapshot is not uploaded again, and chunks are shared between
+// snapshots until GC finds one unreferenced.
+type Store struct {
+	// Create holds it for reading and GC for writing, see GC
+	mu          sync.RWMutex
+	client      *s3.Client
+	bucketName  string
+	prefix      string
+	chunkSize   int
+	concurrency int
+}
+
+func NewStore(client *s3.Client, bucketName, prefix string, chunkSize, concurrency int) (*Store, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	return &Store{
+		client:      client,
+		bucketName:  bucketName,
+		prefix:      prefix,
+		chunkSize:   chunkSize,
+		concurrency: max(concurrency, 1),
+	}, nil
+}
+
+func (s *Store) chunkKey(hash string) string {
+	return s.prefix + "/chunks/" + hash
+}
+
+func (s *Store) manifestKey(offset uint64) string {
+	return fmt.Sprintf("%s/snapshots/%020d", s.prefix, offset)
+}
+
+// Create stores the state read from r as the snapshot at offset, uploading
+// only the chunks that are not in the latest snapshot already.
+func (s *Store) Create(ctx context.Context, offset uint64, r io.Reader) (*Manifest, Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	known := make(map[string]bool)
+	prev, err := s.Latest(ctx)
+	if err != nil && !errors.Is(err, ErrNoSnapshot) {
+		return nil, Stats{}, err
+	}
+	if err == nil {
+		for _, hash := range prev.Chunks {
+			known[hash] = true
+		}
+	}
+
+	m := &Manifest{Offset: offset, ChunkSize: s.chunkSize, Created: time.Now().UTC()}
+	var stats Stats
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var uploadErr error
+	sem := make(chan struct{}, s.concurrency)
+	for {
+		buf := make([]byte, s.chunkSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			wg.Wait()
+			return nil, Stats{}, fmt.Errorf("failed to read state: %w", err)
+		}
+		buf = buf[:n]
+		sum := sha256.Sum256(buf)
+		hash := hex.EncodeToString(sum[:])
+		m.Chunks = append(m.Chunks, hash)
+		m.Size += int64(n)
+		stats.Chunks++
+		if known[hash] {
+			stats.Reused++
+		} else {
+			known[hash] = true
+			stats.Uploaded += int64(n)
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := s.putChunk(ctx, hash, buf); err != nil {
+					mu.Lock()
+					uploadErr = errors.Join(uploadErr, err)
+					mu.Unlock()
+				}
+			}()
+		}
+		if n < s.chunkSize {
+			break
+		}
+	}
+	wg.Wait()
+	if uploadErr != nil {
+		return nil, Stats{}, uploadErr
+	}
+
+	// the manifest goes last, so a snapshot is only visible once all of its
+	// chunks are there
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.manifestKey(offset)),
+		Body:        bytes.NewReader(body),
+		IfNoneMatch: aws.String("*"),
+	})
+	if isPreconditionFailed(err) {
+		return nil, Stats{}, fmt.Errorf("%w at offset %d", ErrSnapshotExists, offset)
+	}
+	if err != nil {
+		return nil, Stats{}, fmt.Errorf("failed to put manifest to S3: %w", err)
+	}
+	return m, stats, nil
+}
+
+func (s *Store) putChunk(ctx context.Context, hash string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.chunkKey(hash)),
+		Body:        bytes.NewReader(data),
+		IfNoneMatch: aws.String("*"),
+	})
+	// the same content was uploaded before, e.g. by an older snapshot
+	if err != nil && !isPreconditionFailed(err) {
+		return fmt.Errorf("failed to put chunk %s to S3: %w", hash, err)
+	}
+	return nil
+}
+
+// manifests returns the offsets of all snapshots in ascending order
+func (s *Store) manifests(ctx context.Context) ([]uint64, error) {
+	var offsets []uint64
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.prefix + "/snapshots/"),
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots from S3: %w", err)
+		}
+		for _, obj := range output.Contents {
+			var offset uint64
+			name := strings.TrimPrefix(*obj.Key, s.prefix+"/snapshots/")
+			if _, err := fmt.Sscanf(name, "%d", &offset); err != nil {
+				return nil, fmt.Errorf("invalid snapshot key %q", *obj.Key)
+			}
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets, nil
+}
+
+// Latest returns the manifest of the most recent snapshot, or ErrNoSnapshot.
+func (s *Store) Latest(ctx context.Context) (*Manifest, error) {
+	offsets, err := s.manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(offsets) == 0 {
+		return nil, ErrNoSnapshot
+	}
+	return s.Manifest(ctx, offsets[len(offsets)-1])
+}
+
+// Manifest returns the manifest of the snapshot at offset.
+func (s *Store) Manifest(ctx context.Context, offset uint64) (*Manifest, error) {
+	body, err := s.get(ctx, s.manifestKey(offset))
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, fmt.Errorf("%w at offset %d", ErrNoSnapshot, offset)
+		}
+		return nil, fmt.Errorf("failed to get manifest from S3: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest at offset %d: %w", offset, err)
+	}
+	return &m, nil
+}
+
+func (s *Store) get(ctx context.Context, key string) ([]byte, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+// Restore writes the state of the snapshot to w, fetching the chunks in
+// parallel. Every chunk is checked against its hash and size before it is
+// written.
+func (s *Store) Restore(ctx context.Context, m *Manifest, w io.WriterAt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.Chunks))
+	sem := make(chan struct{}, s.concurrency)
+	for i, hash := range m.Chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if errs[i] = s.restoreChunk(ctx, m, i, hash, w); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Store) restoreChunk(ctx context.Context, m *Manifest, i int, hash string, w io.WriterAt) error {
+	data, err := s.get(ctx, s.chunkKey(hash))
+	if err != nil {
+		return fmt.Errorf("failed to get chunk %d: %w", i, err)
+	}
+	size := int64(m.ChunkSize)
+	if i == len(m.Chunks)-1 {
+		size = m.Size - int64(i)*int64(m.ChunkSize)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != size || hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("chunk %d does not match its hash %s", i, hash)
+	}
+	if _, err := w.WriteAt(data, int64(i)*int64(m.ChunkSize)); err != nil {
+		return fmt.Errorf("failed to write chunk %d: %w", i, err)
+	}
+	return nil
+}
+
+// GC deletes all but the latest keep snapshots and then every chunk no
+// remaining snapshot refers to. Chunks younger than grace are left alone.
+//
+// GC must not run while a snapshot is being created. Create reuses chunks
+// that are already stored, however old, and GC may delete them before the
+// new manifest refers to them. The grace period does not help there, it only
+// covers chunks Create uploaded itself. A Store makes its own Create and GC
+// calls wait for each other, but Stores in other processes sharing the
+// prefix must be kept apart by the caller.
+func (s *Store) GC(ctx context.Context, keep int, grace time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offsets, err := s.manifests(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	var remove []string
+	for len(offsets) > max(keep, 1) {
+		remove = append(remove, s.manifestKey(offsets[0]))
+		offsets = offsets[1:]
+	}
+	if err := s.delete(ctx, remove); err != nil {
+		return 0, err
+	}
+	deleted += len(remove)
+
+	referenced := make(map[string]bool)
+	for _, offset := range offsets {
+		m, err := s.Manifest(ctx, offset)
+		if err != nil {
+			return deleted, err
+		}
+		for _, hash := range m.Chunks {
+			referenced[hash] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.prefix + "/chunks/"),
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list chunks from S3: %w", err)
+		}
+		remove = remove[:0]
+		for _, obj := range output.Contents {
+			hash := strings.TrimPrefix(*obj.Key, s.prefix+"/chunks/")
+			if !referenced[hash] && aws.ToTime(obj.LastModified).Before(cutoff) {
+				remove = append(remove, *obj.Key)
+			}
+		}
+		if err := s.delete(ctx, remove); err != nil {
+			return deleted, err
+		}
+		deleted += len(remove)
+	}
+	return deleted, nil
+}
+
+// delete removes keys, in batches as DeleteObjects takes at most 1000 keys
+func (s *Store) delete(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		output, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects from S3: %w", err)
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s: %s", aws.ToString(output.Errors[0].Key), aws.ToString(output.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
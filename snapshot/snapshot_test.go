@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/avinassh/s3-log/internal/s3test"
+)
+
+func getStore(t *testing.T, chunkSize int) *Store {
+	client := s3test.Client()
+	store, err := NewStore(client, s3test.Bucket(t, client), "state", chunkSize, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func restore(t *testing.T, store *Store, m *Manifest) ([]byte, error) {
+	path := filepath.Join(t.TempDir(), "state")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = store.Restore(context.Background(), m, f); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func TestIncrementalSnapshots(t *testing.T) {
+	store := getStore(t, 1024)
+	ctx := context.Background()
+
+	if _, err := store.Latest(ctx); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("expected ErrNoSnapshot, got %v", err)
+	}
+
+	state := make([]byte, 10*1024+100)
+	rand.Read(state)
+	m1, stats, err := store.Create(ctx, 10, bytes.NewReader(state))
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	if stats.Chunks != 11 || stats.Reused != 0 || stats.Uploaded != int64(len(state)) {
+		t.Errorf("unexpected stats for the first snapshot: %+v", stats)
+	}
+	first := bytes.Clone(state)
+
+	// change one chunk, only that one is uploaded
+	copy(state[3*1024:], "changed")
+	m2, stats, err := store.Create(ctx, 20, bytes.NewReader(state))
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	if stats.Chunks != 11 || stats.Reused != 10 || stats.Uploaded != 1024 {
+		t.Errorf("expected only the changed chunk to be uploaded, got %+v", stats)
+	}
+	if _, _, err = store.Create(ctx, 20, bytes.NewReader(state)); !errors.Is(err, ErrSnapshotExists) {
+		t.Errorf("expected ErrSnapshotExists, got %v", err)
+	}
+
+	latest, err := store.Latest(ctx)
+	if err != nil || latest.Offset != 20 {
+		t.Fatalf("expected latest snapshot at 20, got %v, %v", latest, err)
+	}
+	for _, tc := range []struct {
+		m    *Manifest
+		want []byte
+	}{{m1, first}, {latest, state}} {
+		got, err := restore(t, store, tc.m)
+		if err != nil {
+			t.Fatalf("failed to restore snapshot at %d: %v", tc.m.Offset, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("restored state at %d does not match", tc.m.Offset)
+		}
+	}
+
+	deleted, err := store.GC(ctx, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+	// the first manifest and the chunk only it used
+	if deleted != 2 {
+		t.Errorf("expected 2 objects deleted, got %d", deleted)
+	}
+	if _, err = restore(t, store, m1); err == nil {
+		t.Error("expected restoring a collected snapshot to fail")
+	}
+	got, err := restore(t, store, m2)
+	if err != nil || !bytes.Equal(got, state) {
+		t.Errorf("failed to restore the kept snapshot: %v", err)
+	}
+
+	// a chunk that does not match its hash fails the restore
+	if err = store.putChunk(ctx, "0000", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := *m2
+	corrupt.Chunks = append([]string{"0000"}, m2.Chunks[1:]...)
+	if _, err = restore(t, store, &corrupt); err == nil {
+		t.Error("expected a corrupt chunk to fail the restore")
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	if _, err := NewStore(nil, "bucket", "state", 0, 4); err == nil {
+		t.Error("expected error for a chunk size of 0, got nil")
+	}
+}
@@ -0,0 +1,443 @@
+package sqlquery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(sql string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(sql) {
+		c := rune(sql[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(sql) && (unicode.IsLetter(rune(sql[i])) || unicode.IsDigit(rune(sql[i])) || sql[i] == '_' || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, sql[start:i], start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(sql) && (unicode.IsDigit(rune(sql[i])) || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, sql[start:i], start})
+		case c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if sql[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(sql[i])
+				i++
+			}
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		default:
+			start := i
+			if i+1 < len(sql) {
+				switch sql[i : i+2] {
+				case "<=", ">=", "!=", "<>":
+					tokens = append(tokens, token{tokSymbol, sql[i : i+2], start})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("(),*=<>-", c) {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokSymbol, string(c), start})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(sql)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword reports whether the next token is the given keyword
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	t := p.peek()
+	return t.kind == tokSymbol && t.text == symbol
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.errorf("expected %s", strings.ToUpper(keyword))
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.isSymbol(symbol) {
+		return p.errorf("expected %q", symbol)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	t := p.peek()
+	found := t.text
+	if t.kind == tokEOF {
+		found = "end of query"
+	}
+	return fmt.Errorf("%s at %d, found %q", fmt.Sprintf(format, args...), t.pos, found)
+}
+
+var reserved = map[string]bool{
+	"select": true, "from": true, "where": true, "group": true, "by": true,
+	"limit": true, "and": true, "or": true, "not": true, "as": true,
+}
+
+func (p *parser) parseQuery() (*Query, error) {
+	q := &Query{}
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		q.items = append(q.items, item)
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("log") {
+		return nil, p.errorf("expected table log")
+	}
+	p.next()
+
+	if p.isKeyword("where") {
+		p.next()
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if containsAggregate(where) {
+			return nil, fmt.Errorf("aggregates are not allowed in WHERE")
+		}
+		q.where = where
+	}
+
+	if p.isKeyword("group") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if containsAggregate(e) {
+				return nil, fmt.Errorf("aggregates are not allowed in GROUP BY")
+			}
+			q.groupBy = append(q.groupBy, e)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("limit") {
+		p.next()
+		t := p.next()
+		limit, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid LIMIT %q", t.text)
+		}
+		q.limit = limit
+		q.hasLimit = true
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected input")
+	}
+	return q, nil
+}
+
+func (p *parser) parseSelectItem() (selectItem, error) {
+	if p.isSymbol("*") {
+		p.next()
+		return selectItem{star: true, name: "*"}, nil
+	}
+	start := p.peek().pos
+	e, err := p.parseExpr()
+	if err != nil {
+		return selectItem{}, err
+	}
+	item := selectItem{expr: e, name: exprName(e, start)}
+	if p.isKeyword("as") {
+		p.next()
+		t := p.next()
+		if t.kind != tokIdent {
+			return selectItem{}, fmt.Errorf("expected alias after AS at %d", t.pos)
+		}
+		item.name = t.text
+	}
+	return item, nil
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.isKeyword("not") {
+		p.next()
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tokSymbol {
+		return left, nil
+	}
+	switch t.text {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "<>" {
+			op = "!="
+		}
+		// strings compared with the timestamp are parsed once here
+		for _, side := range []*expr{&left, &right} {
+			l, ok := (*side).(*literal)
+			if !ok || !isTimestamp(left) && !isTimestamp(right) {
+				continue
+			}
+			if s, ok := l.value.(string); ok {
+				ts, err := parseTime(s)
+				if err != nil {
+					return nil, fmt.Errorf("%w at %d", err, t.pos)
+				}
+				*side = &literal{ts}
+			}
+		}
+		return &compareExpr{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &literal{n}, nil
+	case t.kind == tokString:
+		p.next()
+		return &literal{t.text}, nil
+	case t.kind == tokSymbol && t.text == "-":
+		p.next()
+		n := p.next()
+		v, err := strconv.ParseFloat(n.text, 64)
+		if n.kind != tokNumber || err != nil {
+			return nil, fmt.Errorf("expected number after - at %d", t.pos)
+		}
+		return &literal{-v}, nil
+	case t.kind == tokSymbol && t.text == "(":
+		p.next()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+	case t.kind == tokIdent:
+		lower := strings.ToLower(t.text)
+		switch lower {
+		case "true":
+			p.next()
+			return &literal{true}, nil
+		case "false":
+			p.next()
+			return &literal{false}, nil
+		case "null":
+			p.next()
+			return &literal{nil}, nil
+		}
+		if reserved[lower] {
+			return nil, p.errorf("unexpected keyword")
+		}
+		p.next()
+		if p.isSymbol("(") {
+			return p.parseCall(lower)
+		}
+		return &column{path: strings.Split(t.text, ".")}, nil
+	}
+	return nil, p.errorf("expected expression")
+}
+
+func (p *parser) parseCall(name string) (expr, error) {
+	switch name {
+	case "count", "sum", "min", "max", "avg":
+	default:
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.next() // (
+	call := &aggregateExpr{fn: name}
+	if name == "count" && p.isSymbol("*") {
+		p.next()
+	} else {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if containsAggregate(arg) {
+			return nil, fmt.Errorf("nested aggregates are not allowed")
+		}
+		call.arg = arg
+	}
+	return call, p.expectSymbol(")")
+}
+
+func containsAggregate(e expr) bool {
+	switch e := e.(type) {
+	case *aggregateExpr:
+		return true
+	case *logicalExpr:
+		return containsAggregate(e.left) || containsAggregate(e.right)
+	case *notExpr:
+		return containsAggregate(e.e)
+	case *compareExpr:
+		return containsAggregate(e.left) || containsAggregate(e.right)
+	}
+	return false
+}
+
+func containsColumn(e expr) bool {
+	switch e := e.(type) {
+	case *column:
+		return true
+	case *aggregateExpr:
+		return e.arg != nil && containsColumn(e.arg)
+	case *logicalExpr:
+		return containsColumn(e.left) || containsColumn(e.right)
+	case *notExpr:
+		return containsColumn(e.e)
+	case *compareExpr:
+		return containsColumn(e.left) || containsColumn(e.right)
+	}
+	return false
+}
+
+func exprName(e expr, pos int) string {
+	switch e := e.(type) {
+	case *column:
+		return strings.Join(e.path, ".")
+	case *aggregateExpr:
+		if e.arg == nil {
+			return e.fn + "(*)"
+		}
+		return e.fn + "(" + exprName(e.arg, pos) + ")"
+	}
+	return fmt.Sprintf("col%d", pos)
+}
@@ -0,0 +1,667 @@
+package sqlquery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// Query is a parsed SQL query over the records of a log. The records are
+// decoded as JSON objects whose fields are the columns of the table `log`,
+// with dotted names reaching into nested objects, plus `offset` for the
+// offset of the record and `timestamp` for when it was written. Timestamps
+// are compared with RFC 3339 strings or dates, e.g.
+// `timestamp >= '2024-01-02T15:04:05Z'`, and are null for WALs that do not
+// implement InfoWAL. The supported subset is
+//
+//	SELECT * | expr [AS name], ... FROM log
+//	[WHERE expr] [GROUP BY expr, ...] [LIMIT n]
+//
+// with comparisons, AND, OR, NOT and the aggregates count, sum, min, max
+// and avg.
+type Query struct {
+	items    []selectItem
+	where    expr
+	groupBy  []expr
+	limit    int
+	hasLimit bool
+}
+
+type Result struct {
+	Columns []string
+	Rows    [][]any
+}
+
+type selectItem struct {
+	expr expr
+	name string
+	star bool
+}
+
+// InfoWAL is a WAL that can also return the details of a record object,
+// such as *s3_log.S3WAL. The timestamp column is its LastModified.
+type InfoWAL interface {
+	s3_log.WAL
+	ReadWithInfo(ctx context.Context, offset uint64) (s3_log.Record, s3_log.RecordInfo, error)
+	HeadRecord(ctx context.Context, offset uint64) (s3_log.RecordInfo, error)
+}
+
+type row struct {
+	offset    uint64
+	timestamp time.Time
+	data      any
+}
+
+type expr interface {
+	eval(r row) any
+}
+
+type literal struct {
+	value any
+}
+
+func (l *literal) eval(r row) any {
+	return l.value
+}
+
+type column struct {
+	path []string
+}
+
+func (c *column) eval(r row) any {
+	if len(c.path) == 1 && c.path[0] == "offset" {
+		return float64(r.offset)
+	}
+	if len(c.path) == 1 && c.path[0] == "timestamp" {
+		if r.timestamp.IsZero() {
+			return nil
+		}
+		return r.timestamp
+	}
+	v := r.data
+	for _, name := range c.path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = obj[name]
+	}
+	return v
+}
+
+type logicalExpr struct {
+	op          string
+	left, right expr
+}
+
+func (l *logicalExpr) eval(r row) any {
+	left := l.left.eval(r) == true
+	if l.op == "and" {
+		return left && l.right.eval(r) == true
+	}
+	return left || l.right.eval(r) == true
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (n *notExpr) eval(r row) any {
+	return n.e.eval(r) != true
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+func (c *compareExpr) eval(r row) any {
+	cmp, ok := compareValues(c.left.eval(r), c.right.eval(r))
+	if !ok {
+		// like SQL NULL, comparing values of different types is never true
+		return false
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// aggregateExpr is only evaluated through an accumulator, eval is never
+// called on it since Parse rejects aggregates outside the select list
+type aggregateExpr struct {
+	fn  string
+	arg expr
+}
+
+func (a *aggregateExpr) eval(r row) any {
+	return nil
+}
+
+func compareValues(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func Parse(sql string) (*Query, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range q.items {
+		if item.star && q.grouped() {
+			return nil, fmt.Errorf("SELECT * cannot be used with aggregates or GROUP BY")
+		}
+		if _, ok := item.expr.(*aggregateExpr); ok || item.expr == nil {
+			continue
+		}
+		if containsAggregate(item.expr) {
+			return nil, fmt.Errorf("aggregates must not be nested in expressions")
+		}
+		// a column has no single value for a group unless it is grouped by
+		if q.grouped() && containsColumn(item.expr) && !slices.ContainsFunc(q.groupBy, func(e expr) bool {
+			return reflect.DeepEqual(e, item.expr)
+		}) {
+			return nil, fmt.Errorf("%s must appear in GROUP BY or be used in an aggregate", item.name)
+		}
+	}
+	return q, nil
+}
+
+func (q *Query) grouped() bool {
+	if len(q.groupBy) > 0 {
+		return true
+	}
+	for _, item := range q.items {
+		if _, ok := item.expr.(*aggregateExpr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) Columns() []string {
+	var columns []string
+	for _, item := range q.items {
+		if item.star {
+			columns = append(columns, "offset", "data")
+			continue
+		}
+		columns = append(columns, item.name)
+	}
+	return columns
+}
+
+// Range returns the offsets the query can match, derived from the offset
+// comparisons that are ANDed together in the WHERE clause, so that only
+// those records need to be read from S3.
+func (q *Query) Range() (uint64, uint64) {
+	from, to := uint64(1), uint64(math.MaxUint64)
+	var visit func(e expr)
+	visit = func(e expr) {
+		switch e := e.(type) {
+		case *logicalExpr:
+			if e.op == "and" {
+				visit(e.left)
+				visit(e.right)
+			}
+		case *compareExpr:
+			op, n, ok := offsetBound(e)
+			if !ok {
+				return
+			}
+			lo, hi := boundRange(op, n)
+			from, to = max(from, lo), min(to, hi)
+		}
+	}
+	if q.where != nil {
+		visit(q.where)
+	}
+	return from, to
+}
+
+// offsetBound matches `offset <op> n` and `n <op> offset`, returning the
+// comparison with offset on the left
+func offsetBound(c *compareExpr) (string, float64, bool) {
+	isOffset := func(e expr) bool {
+		col, ok := e.(*column)
+		return ok && len(col.path) == 1 && col.path[0] == "offset"
+	}
+	number := func(e expr) (float64, bool) {
+		l, ok := e.(*literal)
+		if !ok {
+			return 0, false
+		}
+		n, ok := l.value.(float64)
+		return n, ok
+	}
+	if n, ok := number(c.right); ok && isOffset(c.left) {
+		return c.op, n, true
+	}
+	if n, ok := number(c.left); ok && isOffset(c.right) {
+		flipped := map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<=", "=": "=", "!=": "!="}
+		return flipped[c.op], n, true
+	}
+	return "", 0, false
+}
+
+// boundRange returns the offsets satisfying `offset <op> n`. An empty range
+// is returned as lo > hi.
+func boundRange(op string, n float64) (uint64, uint64) {
+	toOffset := func(f float64) uint64 {
+		switch {
+		case f < 0:
+			return 0
+		case f >= math.MaxUint64:
+			return math.MaxUint64
+		}
+		return uint64(f)
+	}
+	switch op {
+	case ">":
+		return toOffset(math.Floor(n) + 1), math.MaxUint64
+	case ">=":
+		return toOffset(math.Ceil(n)), math.MaxUint64
+	case "<":
+		if n <= 1 {
+			return 1, 0
+		}
+		return 0, toOffset(math.Ceil(n) - 1)
+	case "<=":
+		if n < 1 {
+			return 1, 0
+		}
+		return 0, toOffset(math.Floor(n))
+	case "=":
+		if n != math.Trunc(n) || n < 1 {
+			return 1, 0
+		}
+		return toOffset(n), toOffset(n)
+	}
+	return 0, math.MaxUint64
+}
+
+// TimeRange returns the earliest and latest timestamps the query can match,
+// derived like Range from the timestamp comparisons ANDed together in the
+// WHERE clause. A zero time means that side is unbounded. Both bounds are
+// inclusive, the WHERE clause still filters out records at a strict bound.
+func (q *Query) TimeRange() (time.Time, time.Time) {
+	var since, until time.Time
+	var visit func(e expr)
+	visit = func(e expr) {
+		switch e := e.(type) {
+		case *logicalExpr:
+			if e.op == "and" {
+				visit(e.left)
+				visit(e.right)
+			}
+		case *compareExpr:
+			op, t, ok := timeBound(e)
+			if !ok {
+				return
+			}
+			if (op == ">" || op == ">=" || op == "=") && t.After(since) {
+				since = t
+			}
+			if (op == "<" || op == "<=" || op == "=") && (until.IsZero() || t.Before(until)) {
+				until = t
+			}
+		}
+	}
+	if q.where != nil {
+		visit(q.where)
+	}
+	return since, until
+}
+
+// timeBound matches `timestamp <op> t` and `t <op> timestamp`, returning the
+// comparison with timestamp on the left
+func timeBound(c *compareExpr) (string, time.Time, bool) {
+	t, ok := timeLiteral(c.right)
+	if ok && isTimestamp(c.left) {
+		return c.op, t, true
+	}
+	if t, ok = timeLiteral(c.left); ok && isTimestamp(c.right) {
+		flipped := map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<=", "=": "=", "!=": "!="}
+		return flipped[c.op], t, true
+	}
+	return "", time.Time{}, false
+}
+
+func isTimestamp(e expr) bool {
+	col, ok := e.(*column)
+	return ok && len(col.path) == 1 && col.path[0] == "timestamp"
+}
+
+func timeLiteral(e expr) (time.Time, bool) {
+	l, ok := e.(*literal)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, ok := l.value.(time.Time)
+	return t, ok
+}
+
+// parseTime parses the string a timestamp is compared with
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC 3339 or YYYY-MM-DD", s)
+}
+
+// OffsetsBetween narrows [from, to] down to the records written between
+// since and until, both inclusive, by binary searching the LastModified of
+// the record objects. A zero time leaves that side open. S3 sets
+// LastModified when a write completes and the appends to a log complete in
+// order, so it does not decrease along the log. An empty range is returned
+// as from > to. Like Run, [from, to] must not extend past the end of the log.
+func OffsetsBetween(ctx context.Context, wal InfoWAL, from, to uint64, since, until time.Time) (uint64, uint64, error) {
+	// search returns the first offset in [from, to] for which after is
+	// true of its LastModified, if any
+	search := func(after func(t time.Time) bool) (uint64, bool, error) {
+		var first uint64
+		var found bool
+		for lo, hi := from, to; lo <= hi; {
+			mid := lo + (hi-lo)/2
+			info, err := wal.HeadRecord(ctx, mid)
+			if err != nil && !errors.Is(err, s3_log.ErrSealed) {
+				return 0, false, fmt.Errorf("failed to head offset %d: %w", mid, err)
+			}
+			// the seal marker comes after every record
+			if err == nil && !after(info.LastModified) {
+				lo = mid + 1
+				continue
+			}
+			first, found = mid, true
+			if mid == lo {
+				break
+			}
+			hi = mid - 1
+		}
+		return first, found, nil
+	}
+	if !since.IsZero() {
+		first, found, err := search(func(t time.Time) bool { return !t.Before(since) })
+		if err != nil {
+			return 0, 0, err
+		}
+		if !found {
+			return 1, 0, nil
+		}
+		from = first
+	}
+	if !until.IsZero() {
+		next, found, err := search(func(t time.Time) bool { return t.After(until) })
+		if err != nil {
+			return 0, 0, err
+		}
+		if found {
+			if next == from {
+				return 1, 0, nil
+			}
+			to = next - 1
+		}
+	}
+	return from, to, nil
+}
+
+// Run evaluates the query over the records in [from, to], narrowed down to
+// Range and, for an InfoWAL, TimeRange. It stops early at the end of a
+// sealed log.
+func (q *Query) Run(ctx context.Context, wal s3_log.WAL, from, to uint64) (*Result, error) {
+	lo, hi := q.Range()
+	from, to = max(from, lo), min(to, hi)
+	infoWAL, withInfo := wal.(InfoWAL)
+	if since, until := q.TimeRange(); withInfo && from <= to && (!since.IsZero() || !until.IsZero()) {
+		var err error
+		from, to, err = OffsetsBetween(ctx, infoWAL, from, to, since, until)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out outputter = &plainOutput{q: q}
+	if q.grouped() {
+		out = newGroupedOutput(q)
+	}
+	for offset := from; offset <= to && offset != 0; offset++ {
+		var record s3_log.Record
+		var info s3_log.RecordInfo
+		var err error
+		if withInfo {
+			record, info, err = infoWAL.ReadWithInfo(ctx, offset)
+		} else {
+			record, err = wal.Read(ctx, offset)
+		}
+		if errors.Is(err, s3_log.ErrSealed) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offset %d: %w", offset, err)
+		}
+		r := row{offset: record.Offset, timestamp: info.LastModified}
+		if err = json.Unmarshal(record.Data, &r.data); err != nil {
+			// not JSON, every column but offset is null
+			r.data = nil
+		}
+		if q.where != nil && q.where.eval(r) != true {
+			continue
+		}
+		if done := out.add(r); done {
+			break
+		}
+	}
+	return &Result{Columns: q.Columns(), Rows: out.rows()}, nil
+}
+
+type outputter interface {
+	// add consumes a matching row and reports whether the query is done
+	add(r row) bool
+	rows() [][]any
+}
+
+type plainOutput struct {
+	q   *Query
+	out [][]any
+}
+
+func (p *plainOutput) add(r row) bool {
+	var values []any
+	for _, item := range p.q.items {
+		if item.star {
+			values = append(values, float64(r.offset), r.data)
+			continue
+		}
+		values = append(values, item.expr.eval(r))
+	}
+	p.out = append(p.out, values)
+	return p.q.hasLimit && len(p.out) >= p.q.limit
+}
+
+func (p *plainOutput) rows() [][]any {
+	return p.out
+}
+
+type group struct {
+	first row
+	accs  []*accumulator
+}
+
+type groupedOutput struct {
+	q      *Query
+	groups map[string]*group
+	order  []string
+}
+
+func newGroupedOutput(q *Query) *groupedOutput {
+	return &groupedOutput{q: q, groups: make(map[string]*group)}
+}
+
+func (g *groupedOutput) add(r row) bool {
+	var sb strings.Builder
+	for _, e := range g.q.groupBy {
+		fmt.Fprintf(&sb, "%T:%v|", e.eval(r), e.eval(r))
+	}
+	key := sb.String()
+	grp, ok := g.groups[key]
+	if !ok {
+		grp = &group{first: r, accs: make([]*accumulator, len(g.q.items))}
+		for i, item := range g.q.items {
+			if agg, ok := item.expr.(*aggregateExpr); ok {
+				grp.accs[i] = &accumulator{agg: agg}
+			}
+		}
+		g.groups[key] = grp
+		g.order = append(g.order, key)
+	}
+	for _, acc := range grp.accs {
+		if acc != nil {
+			acc.add(r)
+		}
+	}
+	return false
+}
+
+func (g *groupedOutput) rows() [][]any {
+	var out [][]any
+	for _, key := range g.order {
+		if g.q.hasLimit && len(out) >= g.q.limit {
+			break
+		}
+		grp := g.groups[key]
+		values := make([]any, len(g.q.items))
+		for i, item := range g.q.items {
+			if grp.accs[i] != nil {
+				values[i] = grp.accs[i].result()
+				continue
+			}
+			values[i] = item.expr.eval(grp.first)
+		}
+		out = append(out, values)
+	}
+	// an aggregate over no rows still yields one row, as in SQL
+	if len(out) == 0 && len(g.q.groupBy) == 0 && (!g.q.hasLimit || g.q.limit > 0) {
+		values := make([]any, len(g.q.items))
+		for i, item := range g.q.items {
+			if agg, ok := item.expr.(*aggregateExpr); ok {
+				values[i] = (&accumulator{agg: agg}).result()
+				continue
+			}
+			// Parse only lets constant expressions through here
+			values[i] = item.expr.eval(row{})
+		}
+		out = append(out, values)
+	}
+	return out
+}
+
+type accumulator struct {
+	agg      *aggregateExpr
+	count    int
+	sum      float64
+	extreme  any
+	hasValue bool
+}
+
+func (a *accumulator) add(r row) {
+	if a.agg.arg == nil {
+		a.count++
+		return
+	}
+	v := a.agg.arg.eval(r)
+	if v == nil {
+		return
+	}
+	switch a.agg.fn {
+	case "count":
+		a.count++
+	case "sum", "avg":
+		if n, ok := v.(float64); ok {
+			a.count++
+			a.sum += n
+		}
+	case "min", "max":
+		if !a.hasValue {
+			a.extreme, a.hasValue = v, true
+			return
+		}
+		cmp, ok := compareValues(v, a.extreme)
+		if ok && (a.agg.fn == "min" && cmp < 0 || a.agg.fn == "max" && cmp > 0) {
+			a.extreme = v
+		}
+	}
+}
+
+func (a *accumulator) result() any {
+	switch a.agg.fn {
+	case "count":
+		return float64(a.count)
+	case "sum":
+		if a.count == 0 {
+			return nil
+		}
+		return a.sum
+	case "avg":
+		if a.count == 0 {
+			return nil
+		}
+		return a.sum / float64(a.count)
+	}
+	return a.extreme
+}
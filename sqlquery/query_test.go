@@ -0,0 +1,239 @@
+package sqlquery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/s3test"
+	"github.com/avinassh/s3-log/internal/waltest"
+)
+
+func newTestWAL() *waltest.MemWAL {
+	wal := &waltest.MemWAL{}
+	ctx := context.Background()
+	wal.Append(ctx, []byte(`{"key":"a","ts":"2024-01-01","value":1}`))
+	wal.Append(ctx, []byte(`{"key":"b","ts":"2024-01-02","value":2}`))
+	wal.Append(ctx, []byte(`{"key":"a","ts":"2024-01-03","value":3}`))
+	wal.Append(ctx, []byte(`not json`))
+	wal.Append(ctx, []byte(`{"key":"a","ts":"2024-01-05","value":5,"meta":{"ok":true}}`))
+	return wal
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		sql     string
+		columns []string
+		rows    [][]any
+	}{
+		{
+			sql:     `SELECT key, count(*) FROM log WHERE ts > '2024-01-01' GROUP BY key`,
+			columns: []string{"key", "count(*)"},
+			rows:    [][]any{{"b", 1.0}, {"a", 2.0}},
+		},
+		{
+			sql:     `select offset, value as v from log where key = 'a' and not meta.ok = true`,
+			columns: []string{"offset", "v"},
+			rows:    [][]any{{1.0, 1.0}, {3.0, 3.0}},
+		},
+		{
+			sql:     `SELECT sum(value), avg(value), min(ts), max(ts), count(value) FROM log`,
+			columns: []string{"sum(value)", "avg(value)", "min(ts)", "max(ts)", "count(value)"},
+			rows:    [][]any{{11.0, 2.75, "2024-01-01", "2024-01-05", 4.0}},
+		},
+		{
+			sql:     `SELECT offset FROM log WHERE key = 'a' OR key = 'b' LIMIT 2`,
+			columns: []string{"offset"},
+			rows:    [][]any{{1.0}, {2.0}},
+		},
+		{
+			sql:     `SELECT count(*) FROM log WHERE key = 'missing'`,
+			columns: []string{"count(*)"},
+			rows:    [][]any{{0.0}},
+		},
+		{
+			sql:     `SELECT 'none' AS label, count(*) FROM log WHERE key = 'missing'`,
+			columns: []string{"label", "count(*)"},
+			rows:    [][]any{{"none", 0.0}},
+		},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.sql)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tt.sql, err)
+		}
+		result, err := q.Run(context.Background(), newTestWAL(), 1, 5)
+		if err != nil {
+			t.Fatalf("failed to run %q: %v", tt.sql, err)
+		}
+		if !reflect.DeepEqual(result.Columns, tt.columns) {
+			t.Errorf("%q: expected columns %v, got %v", tt.sql, tt.columns, result.Columns)
+		}
+		if !reflect.DeepEqual(result.Rows, tt.rows) {
+			t.Errorf("%q: expected rows %v, got %v", tt.sql, tt.rows, result.Rows)
+		}
+	}
+}
+
+func TestQueryRangePushdown(t *testing.T) {
+	tests := []struct {
+		sql      string
+		from, to uint64
+	}{
+		{`SELECT * FROM log`, 1, math.MaxUint64},
+		{`SELECT * FROM log WHERE offset > 2 AND offset <= 4`, 3, 4},
+		{`SELECT * FROM log WHERE 3 <= offset AND key = 'a'`, 3, math.MaxUint64},
+		{`SELECT * FROM log WHERE offset = 2`, 2, 2},
+		{`SELECT * FROM log WHERE offset < 2 OR offset > 4`, 1, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.sql)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tt.sql, err)
+		}
+		from, to := q.Range()
+		if from != tt.from || to != tt.to {
+			t.Errorf("%q: expected range [%d, %d], got [%d, %d]", tt.sql, tt.from, tt.to, from, to)
+		}
+	}
+
+	wal := newTestWAL()
+	q, _ := Parse(`SELECT offset FROM log WHERE offset >= 4`)
+	if _, err := q.Run(context.Background(), wal, 1, 5); err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if wal.Reads() != 2 {
+		t.Errorf("expected 2 reads with pushdown, got %d", wal.Reads())
+	}
+}
+
+// timedWAL gives the records of a MemWAL the times in written
+type timedWAL struct {
+	*waltest.MemWAL
+	written []time.Time
+}
+
+func (w *timedWAL) ReadWithInfo(ctx context.Context, offset uint64) (s3_log.Record, s3_log.RecordInfo, error) {
+	record, err := w.Read(ctx, offset)
+	if err != nil {
+		return s3_log.Record{}, s3_log.RecordInfo{}, err
+	}
+	return record, s3_log.RecordInfo{LastModified: w.written[offset-1]}, nil
+}
+
+func (w *timedWAL) HeadRecord(ctx context.Context, offset uint64) (s3_log.RecordInfo, error) {
+	if offset == 0 || offset > uint64(len(w.written)) {
+		return s3_log.RecordInfo{}, fmt.Errorf("offset %d not found", offset)
+	}
+	return s3_log.RecordInfo{LastModified: w.written[offset-1]}, nil
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	// two records are written on the 3rd
+	wal := &timedWAL{MemWAL: newTestWAL(), written: []time.Time{day(1), day(2), day(3), day(3), day(5)}}
+
+	tests := []struct {
+		sql          string
+		since, until time.Time
+		rows         [][]any
+		reads        int
+	}{
+		{`SELECT offset FROM log WHERE timestamp >= '2024-01-03'`, day(3), time.Time{}, [][]any{{3.0}, {4.0}, {5.0}}, 3},
+		{`SELECT offset FROM log WHERE timestamp > '2024-01-03' AND '2024-01-06' > timestamp`, day(3), day(6), [][]any{{5.0}}, 3},
+		{`SELECT offset, timestamp FROM log WHERE timestamp = '2024-01-02T00:00:00Z'`, day(2), day(2), [][]any{{2.0, day(2)}}, 1},
+		{`SELECT offset FROM log WHERE timestamp < '2024-01-02 12:00:00' OR key = 'b'`, time.Time{}, time.Time{}, [][]any{{1.0}, {2.0}}, 5},
+		{`SELECT offset FROM log WHERE timestamp > '2024-01-05'`, day(5), time.Time{}, nil, 1},
+		{`SELECT offset FROM log WHERE timestamp < '2023-12-31'`, time.Time{}, day(0), nil, 0},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.sql)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tt.sql, err)
+		}
+		if since, until := q.TimeRange(); !since.Equal(tt.since) || !until.Equal(tt.until) {
+			t.Errorf("%q: expected time range [%v, %v], got [%v, %v]", tt.sql, tt.since, tt.until, since, until)
+		}
+		before := wal.Reads()
+		result, err := q.Run(context.Background(), wal, 1, 5)
+		if err != nil {
+			t.Fatalf("failed to run %q: %v", tt.sql, err)
+		}
+		if !reflect.DeepEqual(result.Rows, tt.rows) {
+			t.Errorf("%q: expected rows %v, got %v", tt.sql, tt.rows, result.Rows)
+		}
+		if reads := wal.Reads() - before; reads != tt.reads {
+			t.Errorf("%q: expected %d reads with pushdown, got %d", tt.sql, tt.reads, reads)
+		}
+	}
+
+	// without record details the timestamp is null
+	q, _ := Parse(`SELECT offset, timestamp FROM log WHERE offset = 1`)
+	result, err := q.Run(context.Background(), newTestWAL(), 1, 5)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if !reflect.DeepEqual(result.Rows, [][]any{{1.0, nil}}) {
+		t.Errorf("expected a null timestamp, got %v", result.Rows)
+	}
+}
+
+func TestQueryTimeRangeS3(t *testing.T) {
+	client := s3test.Client()
+	wal := s3_log.NewS3WAL(client, s3test.Bucket(t, client), s3test.RandomStr())
+	ctx := context.Background()
+	for i := range 6 {
+		// LastModified has a resolution of a second
+		if i == 3 {
+			time.Sleep(1100 * time.Millisecond)
+		}
+		if _, err := wal.Append(ctx, []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	info, err := wal.HeadRecord(ctx, 4)
+	if err != nil {
+		t.Fatalf("failed to head record: %v", err)
+	}
+
+	from, to, err := OffsetsBetween(ctx, wal, 1, 6, info.LastModified, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to resolve time range: %v", err)
+	}
+	if from != 4 || to != 6 {
+		t.Errorf("expected offsets [4, 6], got [%d, %d]", from, to)
+	}
+	q, _ := Parse(`SELECT n FROM log WHERE timestamp < '` + info.LastModified.Format(time.RFC3339) + `'`)
+	result, err := q.Run(ctx, wal, 1, 6)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if !reflect.DeepEqual(result.Rows, [][]any{{0.0}, {1.0}, {2.0}}) {
+		t.Errorf("expected the records before the pause, got %v", result.Rows)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, sql := range []string{
+		`SELECT FROM log`,
+		`SELECT key FROM events`,
+		`SELECT key FROM log WHERE count(*) > 1`,
+		`SELECT *, count(*) FROM log`,
+		`SELECT key FROM log LIMIT -1`,
+		`SELECT key FROM log WHERE key = 'a`,
+		`SELECT upper(key) FROM log`,
+		`SELECT key, count(*) FROM log WHERE key = 'missing'`,
+		`SELECT value, count(*) FROM log GROUP BY key`,
+		`SELECT key FROM log WHERE timestamp > 'yesterday'`,
+	} {
+		if _, err := Parse(sql); err == nil {
+			t.Errorf("expected error parsing %q, got nil", sql)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// Entry is a record read from a partition.
+type Entry struct {
+	Partition string
+	Record    s3_log.Record
+}
+
+// Reader reads all partitions of a topic. It only starts on the children of
+// a split partition once it has read the parent up to its seal, so records
+// with the same key are read in the order they were written.
+type Reader struct {
+	t    *Topic
+	next map[string]uint64
+	wals map[string]*s3_log.S3WAL
+}
+
+// NewReader returns a reader starting at the given offsets per partition, as
+// returned by Position. Partitions missing from from start at their first
+// record.
+func (t *Topic) NewReader(from map[string]uint64) *Reader {
+	next := maps.Clone(from)
+	if next == nil {
+		next = make(map[string]uint64)
+	}
+	return &Reader{t: t, next: next, wals: make(map[string]*s3_log.S3WAL)}
+}
+
+// NewReaderAt returns a reader resuming from a cursor returned by
+// Reader.Cursor.
+func (t *Topic) NewReaderAt(cursor s3_log.Cursor) *Reader {
+	return t.NewReader(cursor.Partitions)
+}
+
+// finished reports whether the reader is done with a split partition
+func (r *Reader) finished(p Partition) bool {
+	return !p.open() && max(r.next[p.Name], 1) >= p.SealedAt
+}
+
+// Poll reloads the metadata and returns up to limit new records from each
+// partition that can be read. Records of one partition are in order, those
+// of different partitions are not ordered with each other.
+func (r *Reader) Poll(ctx context.Context, limit int) ([]Entry, error) {
+	if err := r.t.Reload(ctx); err != nil {
+		return nil, err
+	}
+	partitions := r.t.Partitions()
+	done := make(map[string]bool, len(partitions))
+	var entries []Entry
+	// parents come before their children, so a parent finished in this poll
+	// lets its children be read right away
+	for _, p := range partitions {
+		if r.finished(p) {
+			done[p.Name] = true
+			continue
+		}
+		if p.Parent != "" && !done[p.Parent] {
+			continue
+		}
+		wal, ok := r.wals[p.Name]
+		if !ok {
+			wal = r.t.WAL(p.Name)
+			r.wals[p.Name] = wal
+		}
+		cursor := s3_log.Cursor{Offset: r.next[p.Name]}
+		records, cursor, err := s3_log.ReadPage(ctx, wal, cursor, limit, nil)
+		for _, record := range records {
+			entries = append(entries, Entry{Partition: p.Name, Record: record})
+		}
+		r.next[p.Name] = cursor.Offset
+		if err != nil {
+			return entries, fmt.Errorf("failed to read partition %s: %w", p.Name, err)
+		}
+		if r.finished(p) {
+			done[p.Name] = true
+		}
+	}
+	return entries, nil
+}
+
+// Position returns the offset to resume from in every partition.
+func (r *Reader) Position() map[string]uint64 {
+	return maps.Clone(r.next)
+}
+
+// Cursor returns the position as a cursor for the log "<bucket>/<topic>",
+// to hand to clients as a token. NewReaderAt resumes from it.
+func (r *Reader) Cursor() s3_log.Cursor {
+	return s3_log.Cursor{Log: r.t.Log(), Partitions: r.Position()}
+}
@@ -0,0 +1,359 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	s3_log "github.com/avinassh/s3-log"
+)
+
+// maxAttempts bounds the retries of an append that keeps running into seals
+// and other writers
+const maxAttempts = 5
+
+var (
+	ErrNoTopic     = errors.New("no such topic")
+	ErrTopicExists = errors.New("topic already exists")
+)
+
+// Partition is one log of a topic, at prefix <topic>/<name>. It takes the
+// keys whose hash is in [Lo, Hi]. A split partition is sealed at SealedAt
+// and its keys go to its two Children, which divide its range in half.
+type Partition struct {
+	Name     string   `json:"name"`
+	Parent   string   `json:"parent,omitempty"`
+	Children []string `json:"children,omitempty"`
+	Lo       uint32   `json:"lo"`
+	Hi       uint32   `json:"hi"`
+	SealedAt uint64   `json:"sealed_at,omitempty"`
+}
+
+func (p Partition) open() bool {
+	return len(p.Children) == 0
+}
+
+// Metadata is stored as JSON in the object <topic>.topic. Partitions are in
+// the order they were created, so parents come before their children.
+type Metadata struct {
+	Partitions []Partition `json:"partitions"`
+}
+
+// Topic is a set of partitions that records are spread over by key. Records
+// with the same key always land in the same open partition, so they keep
+// their order. Splitting a hot partition keeps the order too: the parent is
+// sealed before the children show up in the metadata, and readers finish the
+// parent before they read its children.
+type Topic struct {
+	client     *s3.Client
+	bucketName string
+	name       string
+
+	mu   sync.Mutex
+	meta Metadata
+	etag string
+	wals map[string]*s3_log.S3WAL
+}
+
+func newTopic(client *s3.Client, bucketName, name string) *Topic {
+	return &Topic{
+		client:     client,
+		bucketName: bucketName,
+		name:       name,
+		wals:       make(map[string]*s3_log.S3WAL),
+	}
+}
+
+// Create creates a topic with n partitions that divide the key space evenly.
+func Create(ctx context.Context, client *s3.Client, bucketName, name string, n int) (*Topic, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("a topic needs at least one partition")
+	}
+	t := newTopic(client, bucketName, name)
+	var meta Metadata
+	size := (uint64(math.MaxUint32) + 1) / uint64(n)
+	for i := 0; i < n; i++ {
+		hi := uint64(i+1)*size - 1
+		if i == n-1 {
+			hi = math.MaxUint32
+		}
+		meta.Partitions = append(meta.Partitions, Partition{
+			Name: fmt.Sprint(i),
+			Lo:   uint32(uint64(i) * size),
+			Hi:   uint32(hi),
+		})
+	}
+	if err := t.put(ctx, meta, ""); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Open opens an existing topic.
+func Open(ctx context.Context, client *s3.Client, bucketName, name string) (*Topic, error) {
+	t := newTopic(client, bucketName, name)
+	if err := t.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Log names the topic in cursors, as "<bucket>/<topic>".
+func (t *Topic) Log() string {
+	return t.bucketName + "/" + t.name
+}
+
+func (t *Topic) metadataKey() string {
+	// outside of `name/`, so that it is not mistaken for a partition
+	return t.name + ".topic"
+}
+
+// Reload fetches the metadata again, e.g. to pick up splits made elsewhere.
+func (t *Topic) Reload(ctx context.Context) error {
+	result, err := t.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucketName),
+		Key:    aws.String(t.metadataKey()),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return fmt.Errorf("%w: %s", ErrNoTopic, t.name)
+		}
+		return fmt.Errorf("failed to get topic metadata from S3: %w", err)
+	}
+	defer result.Body.Close()
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read topic metadata: %w", err)
+	}
+	var meta Metadata
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("failed to decode topic metadata: %w", err)
+	}
+	t.mu.Lock()
+	t.meta, t.etag = meta, aws.ToString(result.ETag)
+	t.mu.Unlock()
+	return nil
+}
+
+// put replaces the metadata if it still has the given ETag, or creates it if
+// etag is empty
+func (t *Topic) put(ctx context.Context, meta Metadata, etag string) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode topic metadata: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(t.bucketName),
+		Key:    aws.String(t.metadataKey()),
+		Body:   bytes.NewReader(data),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	result, err := t.client.PutObject(ctx, input)
+	if err != nil {
+		if etag == "" && isPreconditionFailed(err) {
+			return fmt.Errorf("%w: %s", ErrTopicExists, t.name)
+		}
+		return fmt.Errorf("failed to put topic metadata to S3: %w", err)
+	}
+	t.mu.Lock()
+	t.meta, t.etag = meta, aws.ToString(result.ETag)
+	t.mu.Unlock()
+	return nil
+}
+
+// Partitions returns all partitions of the topic, split ones included.
+func (t *Topic) Partitions() []Partition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Partition(nil), t.meta.Partitions...)
+}
+
+func (t *Topic) partition(name string) (Partition, bool) {
+	for _, p := range t.Partitions() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// WAL returns a new, uninitialised log for the partition.
+func (t *Topic) WAL(partition string) *s3_log.S3WAL {
+	return s3_log.NewS3WAL(t.client, t.bucketName, t.name+"/"+partition)
+}
+
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// route returns the open partition that takes key
+func (t *Topic) route(key []byte) (Partition, error) {
+	h := hashKey(key)
+	for _, p := range t.Partitions() {
+		if p.open() && p.Lo <= h && h <= p.Hi {
+			return p, nil
+		}
+	}
+	return Partition{}, fmt.Errorf("no open partition of topic %s takes hash %d", t.name, h)
+}
+
+// writer returns the log to append to for a partition, initialised on first
+// use
+func (t *Topic) writer(ctx context.Context, partition string) (*s3_log.S3WAL, error) {
+	t.mu.Lock()
+	wal, ok := t.wals[partition]
+	t.mu.Unlock()
+	if ok {
+		return wal, nil
+	}
+	wal = t.WAL(partition)
+	if _, err := wal.LastRecord(ctx); err != nil && !errors.Is(err, s3_log.ErrEmpty) {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.wals[partition] = wal
+	t.mu.Unlock()
+	return wal, nil
+}
+
+// Append appends data to the partition that takes key and returns the
+// partition and offset. If the partition was split since the metadata was
+// loaded, it reloads the metadata and appends to the child instead.
+func (t *Topic) Append(ctx context.Context, key, data []byte) (string, uint64, error) {
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		p, err := t.route(key)
+		if err != nil {
+			return "", 0, err
+		}
+		wal, err := t.writer(ctx, p.Name)
+		if err != nil {
+			return "", 0, err
+		}
+		offset, err := wal.Append(ctx, data)
+		if err == nil {
+			return p.Name, offset, nil
+		}
+		lastErr = err
+		t.mu.Lock()
+		delete(t.wals, p.Name)
+		t.mu.Unlock()
+		switch {
+		case errors.Is(err, s3_log.ErrSealed):
+			// sealed by a split, the children are in the new metadata. A
+			// split in progress has sealed but not yet recorded them.
+			if err := t.Reload(ctx); err != nil {
+				return "", 0, err
+			}
+		case isPreconditionFailed(err):
+			// another writer took the offset, or sealed the partition;
+			// the writer is opened again on the next attempt
+		default:
+			return "", 0, err
+		}
+	}
+	return "", 0, fmt.Errorf("failed to append after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// Split seals an open partition and records two children in the metadata
+// that take the lower and upper half of its keys. The seal comes first, so no
+// record can be appended to the parent once the children exist. If Split
+// fails halfway it can be run again.
+func (t *Topic) Split(ctx context.Context, name string) ([]string, error) {
+	if err := t.Reload(ctx); err != nil {
+		return nil, err
+	}
+	p, ok := t.partition(name)
+	if !ok {
+		return nil, fmt.Errorf("topic %s has no partition %s", t.name, name)
+	}
+	if !p.open() {
+		return p.Children, nil
+	}
+	if p.Lo == p.Hi {
+		return nil, fmt.Errorf("partition %s takes a single hash and cannot be split", name)
+	}
+
+	sealedAt, err := t.seal(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t.mu.Lock()
+		meta, etag := t.meta, t.etag
+		t.mu.Unlock()
+		var partitions []Partition
+		mid := p.Lo + (p.Hi-p.Lo)/2
+		children := []string{name + ".0", name + ".1"}
+		for _, q := range meta.Partitions {
+			if q.Name == name {
+				if !q.open() {
+					// someone else finished the split
+					return q.Children, nil
+				}
+				q.Children = children
+				q.SealedAt = sealedAt
+			}
+			partitions = append(partitions, q)
+		}
+		partitions = append(partitions,
+			Partition{Name: children[0], Parent: name, Lo: p.Lo, Hi: mid},
+			Partition{Name: children[1], Parent: name, Lo: mid + 1, Hi: p.Hi},
+		)
+		err := t.put(ctx, Metadata{Partitions: partitions}, etag)
+		if err == nil {
+			return children, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, err
+		}
+		if err := t.Reload(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// seal seals the log of a partition and returns the offset of its seal
+// marker, also if it was sealed already
+func (t *Topic) seal(ctx context.Context, name string) (uint64, error) {
+	wal := t.WAL(name)
+	for {
+		last, err := wal.LastRecord(ctx)
+		if err != nil && !errors.Is(err, s3_log.ErrEmpty) {
+			return 0, err
+		}
+		offset, err := wal.Seal(ctx, "")
+		if errors.Is(err, s3_log.ErrSealed) {
+			return last.Offset + 1, nil
+		}
+		if isPreconditionFailed(err) {
+			// a writer got to the offset first
+			continue
+		}
+		return offset, err
+	}
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
@@ -0,0 +1,152 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	s3_log "github.com/avinassh/s3-log"
+	"github.com/avinassh/s3-log/internal/s3test"
+)
+
+func setup(t *testing.T) (*s3.Client, string) {
+	client := s3test.Client()
+	return client, s3test.Bucket(t, client)
+}
+
+func TestCreateAndRoute(t *testing.T) {
+	client, bucketName := setup(t)
+	ctx := context.Background()
+
+	topic, err := Create(ctx, client, bucketName, "events", 3)
+	if err != nil {
+		t.Fatalf("failed to create topic: %v", err)
+	}
+	if _, err = Create(ctx, client, bucketName, "events", 3); !errors.Is(err, ErrTopicExists) {
+		t.Errorf("expected ErrTopicExists, got %v", err)
+	}
+	if _, err = Open(ctx, client, bucketName, "missing"); !errors.Is(err, ErrNoTopic) {
+		t.Errorf("expected ErrNoTopic, got %v", err)
+	}
+
+	partitions := topic.Partitions()
+	if len(partitions) != 3 || partitions[0].Lo != 0 || partitions[2].Hi != 1<<32-1 {
+		t.Fatalf("unexpected partitions %+v", partitions)
+	}
+	for i := 1; i < len(partitions); i++ {
+		if partitions[i].Lo != partitions[i-1].Hi+1 {
+			t.Errorf("partitions %d and %d do not cover the key space", i-1, i)
+		}
+	}
+
+	first, _, err := topic.Append(ctx, []byte("user-1"), []byte("a"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	second, offset, err := topic.Append(ctx, []byte("user-1"), []byte("b"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if first != second || offset != 2 {
+		t.Errorf("expected the same key in the same partition at offset 2, got %s and %s at %d", first, second, offset)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	client, bucketName := setup(t)
+	ctx := context.Background()
+
+	topic, err := Create(ctx, client, bucketName, "orders", 1)
+	if err != nil {
+		t.Fatalf("failed to create topic: %v", err)
+	}
+	// a writer that does not know about the split yet
+	stale, err := Open(ctx, client, bucketName, "orders")
+	if err != nil {
+		t.Fatalf("failed to open topic: %v", err)
+	}
+
+	keys := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	write := func(topic *Topic, round int) {
+		for _, key := range keys {
+			if _, _, err := topic.Append(ctx, []byte(key), []byte(fmt.Sprintf("%s-%d", key, round))); err != nil {
+				t.Fatalf("failed to append: %v", err)
+			}
+		}
+	}
+	write(topic, 0)
+	write(stale, 1)
+
+	children, err := topic.Split(ctx, "0")
+	if err != nil {
+		t.Fatalf("failed to split: %v", err)
+	}
+	if fmt.Sprint(children) != "[0.0 0.1]" {
+		t.Errorf("expected children [0.0 0.1], got %v", children)
+	}
+	again, err := topic.Split(ctx, "0")
+	if err != nil || fmt.Sprint(again) != fmt.Sprint(children) {
+		t.Errorf("expected splitting again to return the same children, got %v, %v", again, err)
+	}
+	parent, _ := topic.partition("0")
+	if parent.SealedAt != 13 {
+		t.Errorf("expected parent sealed at 13, got %d", parent.SealedAt)
+	}
+
+	// the stale writer runs into the seal and moves to the children
+	write(stale, 2)
+	write(topic, 3)
+
+	reader := topic.NewReader(nil)
+	seen := make(map[string][]string)
+	var partitions []string
+	for {
+		entries, err := reader.Poll(ctx, 4)
+		if err != nil {
+			t.Fatalf("failed to poll: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			key := string(e.Record.Data[:len(e.Record.Data)-2])
+			seen[key] = append(seen[key], string(e.Record.Data))
+			if len(partitions) == 0 || partitions[len(partitions)-1] != e.Partition {
+				partitions = append(partitions, e.Partition)
+			}
+		}
+	}
+	for _, key := range keys {
+		want := fmt.Sprintf("[%s-0 %s-1 %s-2 %s-3]", key, key, key, key)
+		if fmt.Sprint(seen[key]) != want {
+			t.Errorf("expected %s for %s, got %v", want, key, seen[key])
+		}
+	}
+	// children are only read after the parent
+	for i, p := range partitions {
+		if p == "0" && i > 0 && partitions[i-1] != "0" {
+			t.Errorf("read the parent after a child: %v", partitions)
+		}
+	}
+	pos := reader.Position()
+	if pos["0"] != 13 || pos["0.0"]+pos["0.1"] != 14 {
+		t.Errorf("unexpected position %v", pos)
+	}
+
+	// a reader resumed from the cursor token only sees what came after
+	cursor, err := s3_log.DecodeCursor(reader.Cursor().Encode(), bucketName+"/orders")
+	if err != nil {
+		t.Fatalf("failed to decode cursor: %v", err)
+	}
+	resumed := topic.NewReaderAt(cursor)
+	if _, _, err = topic.Append(ctx, []byte("late"), []byte("late-0")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	entries, err := resumed.Poll(ctx, 10)
+	if err != nil || len(entries) != 1 || string(entries[0].Record.Data) != "late-0" {
+		t.Errorf("expected only the late record, got %v, %v", entries, err)
+	}
+}
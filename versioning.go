@@ -0,0 +1,138 @@
+package s3_log
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// NewVersionedS3WAL returns a WAL for a bucket with versioning enabled. It
+// remembers the VersionId of every record it appends, and Read always fetches
+// the version that was appended first, so overwriting a record object in the
+// bucket does not change what the log returns. Use VerifyVersions to find
+// such overwrites.
+func NewVersionedS3WAL(client *s3.Client, bucketName, prefix string) *S3WAL {
+	w := NewS3WAL(client, bucketName, prefix)
+	w.versioned = true
+	w.versions = make(map[uint64]string)
+	return w
+}
+
+func (w *S3WAL) recordVersion(offset uint64, output *s3.PutObjectOutput) {
+	if w.versioned {
+		w.cacheVersion(offset, aws.ToString(output.VersionId))
+	}
+}
+
+func (w *S3WAL) cacheVersion(offset uint64, version string) {
+	w.versionsMu.Lock()
+	defer w.versionsMu.Unlock()
+	w.versions[offset] = version
+}
+
+// VersionID returns the VersionId of the record at offset, as appended by
+// this WAL or found by an earlier Read. It is safe to call concurrently with
+// reads.
+func (w *S3WAL) VersionID(offset uint64) (string, bool) {
+	w.versionsMu.Lock()
+	defer w.versionsMu.Unlock()
+	version, ok := w.versions[offset]
+	return version, ok
+}
+
+// originalVersion returns the VersionId of the first version of the record at
+// offset. Records are only ever created with a conditional put, so any later
+// version was written behind the log's back.
+func (w *S3WAL) originalVersion(ctx context.Context, offset uint64) (string, error) {
+	if version, ok := w.VersionID(offset); ok {
+		return version, nil
+	}
+	key := w.getObjectKey(offset)
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(w.bucketName),
+		Prefix: aws.String(key),
+	}
+	paginator := s3.NewListObjectVersionsPaginator(w.client, input)
+
+	var version string
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to list object versions from S3: %w", err)
+		}
+		// versions are listed newest first
+		for _, v := range output.Versions {
+			if aws.ToString(v.Key) == key {
+				version = aws.ToString(v.VersionId)
+			}
+		}
+	}
+	if version == "" {
+		return "", fmt.Errorf("no version of offset %d found: %w", offset, &types.NoSuchKey{})
+	}
+	// concurrent reads of the same offset may both list the versions, but
+	// they find the same one
+	w.cacheVersion(offset, version)
+	return version, nil
+}
+
+// VerifyVersions lists every version of every object in the log and returns
+// the offsets whose object has more than one version or a delete marker,
+// meaning it was overwritten or deleted after it was appended.
+func (w *S3WAL) VerifyVersions(ctx context.Context) ([]uint64, error) {
+	cp, err := w.PlanScan(ctx, defaultScanParallelism)
+	if err != nil {
+		return nil, err
+	}
+	var tampered []uint64
+	err = w.VerifyVersionsFrom(ctx, &cp, ScanOptions{}, func(offsets []uint64) error {
+		tampered = append(tampered, offsets...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(tampered)
+	return tampered, nil
+}
+
+// VerifyVersionsFrom is VerifyVersions as a resumable scan. found is called
+// with the tampered offsets of every page, before the checkpoint that covers
+// them is saved.
+func (w *S3WAL) VerifyVersionsFrom(ctx context.Context, cp *ScanCheckpoint, opts ScanOptions, found func(offsets []uint64) error) error {
+	return w.ScanVersions(ctx, cp, opts, func(versions []types.ObjectVersion, markers []types.DeleteMarkerEntry) error {
+		// an object that was only written once has a single version, which is
+		// the latest, so any other version or delete marker gives it away
+		var offsets []uint64
+		add := func(key *string) error {
+			offset, err := w.getOffsetFromKey(aws.ToString(key))
+			if err != nil {
+				return fmt.Errorf("failed to parse offset from key: %w", err)
+			}
+			if !slices.Contains(offsets, offset) {
+				offsets = append(offsets, offset)
+			}
+			return nil
+		}
+		for _, v := range versions {
+			if !aws.ToBool(v.IsLatest) {
+				if err := add(v.Key); err != nil {
+					return err
+				}
+			}
+		}
+		for _, m := range markers {
+			if err := add(m.Key); err != nil {
+				return err
+			}
+		}
+		if len(offsets) == 0 {
+			return nil
+		}
+		return found(offsets)
+	})
+}
@@ -0,0 +1,135 @@
+package s3_log
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestVersionedTamperDetection(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	defer enableVersioning(t, wal)()
+
+	versioned := NewVersionedS3WAL(wal.client, wal.bucketName, wal.prefix)
+	original := []byte("the original record")
+	for i := 0; i < 3; i++ {
+		if _, err := versioned.Append(ctx, original); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+	if version, ok := versioned.VersionID(2); !ok || version == "" {
+		t.Errorf("expected a VersionId for offset 2, got %q", version)
+	}
+
+	// an admin overwrites offset 2 with a well formed body
+	forged, err := prepareBody(2, []byte("a forged record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wal.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(wal.bucketName),
+		Key:    aws.String(wal.getObjectKey(2)),
+		Body:   bytes.NewReader(forged),
+	})
+	if err != nil {
+		t.Fatalf("failed to overwrite record: %v", err)
+	}
+
+	// a fresh reader has no versions cached and must find the original
+	reader := NewVersionedS3WAL(wal.client, wal.bucketName, wal.prefix)
+	for _, w := range []*S3WAL{versioned, reader} {
+		record, err := w.Read(ctx, 2)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if string(record.Data) != string(original) {
+			t.Errorf("expected original record %q, got %q", original, record.Data)
+		}
+	}
+
+	tampered, err := reader.VerifyVersions(ctx)
+	if err != nil {
+		t.Fatalf("failed to verify versions: %v", err)
+	}
+	if len(tampered) != 1 || tampered[0] != 2 {
+		t.Errorf("expected offset 2 to be flagged, got %v", tampered)
+	}
+}
+
+// enableVersioning turns on versioning for the bucket of wal and returns a
+// func that deletes every version, since the cleanup of getWAL only deletes
+// the current ones
+func enableVersioning(t *testing.T, wal *S3WAL) func() {
+	ctx := context.Background()
+	_, err := wal.client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+		Bucket: aws.String(wal.bucketName),
+		VersioningConfiguration: &types.VersioningConfiguration{
+			Status: types.BucketVersioningStatusEnabled,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to enable versioning: %v", err)
+	}
+	return func() {
+		output, err := wal.client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+			Bucket: aws.String(wal.bucketName),
+		})
+		if err != nil {
+			return
+		}
+		for _, v := range output.Versions {
+			wal.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(wal.bucketName), Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range output.DeleteMarkers {
+			wal.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(wal.bucketName), Key: m.Key, VersionId: m.VersionId})
+		}
+	}
+}
+
+func TestVersionedConcurrentReads(t *testing.T) {
+	wal, cleanup := getWAL(t)
+	defer cleanup()
+	defer enableVersioning(t, wal)()
+	ctx := context.Background()
+
+	writer := NewVersionedS3WAL(wal.client, wal.bucketName, wal.prefix)
+	for i := 0; i < 5; i++ {
+		if _, err := writer.Append(ctx, []byte(generateRandomStr())); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	// a fresh reader fills its cache from every goroutine at once
+	reader := NewVersionedS3WAL(wal.client, wal.bucketName, wal.prefix)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(offset uint64) {
+			defer wg.Done()
+			if _, err := reader.Read(ctx, offset); err != nil {
+				errs <- err
+			}
+			reader.VersionID(offset)
+		}(uint64(i%5) + 1)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("failed to read: %v", err)
+	}
+	for offset := uint64(1); offset <= 5; offset++ {
+		want, _ := writer.VersionID(offset)
+		if got, ok := reader.VersionID(offset); !ok || got != want {
+			t.Errorf("expected version %q for offset %d, got %q", want, offset, got)
+		}
+	}
+}